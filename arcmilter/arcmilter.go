@@ -1,48 +1,66 @@
 package arcmilter
 
 import (
-	"crypto"
-	"crypto/ed25519"
-	"crypto/rsa"
-	"fmt"
+	"errors"
 	"log"
 	"net"
 	"net/rpc"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/d--j/go-milter"
 	"github.com/k0kubun/pp/v3"
 	"github.com/masa23/arcmilter/config"
-	"github.com/masa23/mmauth"
-	"github.com/masa23/mmauth/arc"
-	"github.com/masa23/mmauth/dkim"
+	"github.com/masa23/arcmilter/signer"
 )
 
 var debug bool
 
 type ARCMilter struct {
 	ctrl *rpc.Client
-}
-
+	conf atomic.Pointer[config.Config]
+	// 処理中の milter セッションの数
+	active atomic.Int64
+	// 接続の受け付けを開始した待ち受けの数
+	accepting atomic.Int64
+	// これまでに受け付けたセッションの数
+	served atomic.Int64
+	// 受け付けたセッションの数が maxSessions に達した時に呼び出す関数
+	maxSessions   int64
+	onMaxSessions func()
+}
+
+// Session は milter のセッションを signer.Message に渡す
 type Session struct {
 	milter.NoOpMilter
-	isARCSign    bool
-	isDKIMSign   bool
-	helo         string
-	remoteAddr   net.IP
-	rcptToDomain string
-	mailFrom     string
-	from         string
-	fromDomain   string
-	conf         *config.Config
-	mmauth       *mmauth.MMAuth
-	authn        string
+	conf    *config.Config
+	listen  *config.MilterListen
+	env     signer.Envelope
+	message *signer.Message
 }
 
-func (a *ARCMilter) Serve(l net.Listener, conf *config.Config) error {
+// Serve は l で受け付けたセッションを conf.MilterListens[index] の処理方針で処理する
+// Protocol が smtp の待ち受けは SMTP で受け付けて NextHop に中継する
+// セッションは SetConfig で設定した設定を使用するため、Serve の前に SetConfig を呼び出す
+func (a *ARCMilter) Serve(l net.Listener, conf *config.Config, index int) error {
+	if a.conf.Load() == nil {
+		return errors.New("config is not set")
+	}
+	listen := conf.MilterListens[index]
+	if listen.IsSMTP() {
+		return a.serveSMTP(l, listen, index)
+	}
 	server := milter.NewServer(
 		milter.WithMilter(func() milter.Milter {
-			return &Session{conf: conf}
+			// セッション開始時点の設定を使い続ける
+			conf := a.conf.Load()
+			// 再読み込みで待ち受けが減った場合は起動時の設定を使う
+			l := &listen
+			if index < len(conf.MilterListens) {
+				l = &conf.MilterListens[index]
+			}
+			return &Session{conf: conf, listen: l}
 		}),
 		milter.WithProtocol(milter.OptNoHeaderReply|
 			milter.OptNoUnknown|milter.OptNoData|milter.OptSkip|
@@ -53,8 +71,8 @@ func (a *ARCMilter) Serve(l net.Listener, conf *config.Config) error {
 		milter.WithMacroRequest(milter.StageMail, []milter.MacroName{milter.MacroAuthAuthen}),
 	)
 	defer server.Close()
-	log.Printf("Start milter server")
-	return server.Serve(l)
+	log.Printf("Start milter server %s:%s policy=%s", listen.Network, listen.Address, listen.Policy)
+	return server.Serve(&trackedListener{Listener: l, a: a})
 }
 
 func New(ctrl *rpc.Client) *ARCMilter {
@@ -65,6 +83,18 @@ func New(ctrl *rpc.Client) *ARCMilter {
 
 func (a *ARCMilter) SetDebug(dbg bool) {
 	debug = dbg
+	signer.SetDebug(dbg)
+}
+
+// SetClock は署名時刻の取得に使用する時計を差し替える
+func (a *ARCMilter) SetClock(clock func() time.Time) {
+	signer.SetClock(clock)
+}
+
+// SetConfig は新しいセッションで使用する設定を差し替える
+// 処理中のセッションは開始時点の設定で処理を続ける
+func (a *ARCMilter) SetConfig(conf *config.Config) {
+	a.conf.Store(conf)
 }
 
 func (s *Session) logError(format string, v ...interface{}) {
@@ -77,315 +107,102 @@ func (s *Session) debugLog(format string, v ...interface{}) {
 	}
 }
 
-func (s *Session) closeMMAuth() {
-	if s.mmauth == nil {
+// closeMessage は処理中のメッセージを破棄する
+func (s *Session) closeMessage() {
+	if s.message == nil {
 		return
 	}
-	if err := s.mmauth.Close(); err != nil {
-		s.logError("s.mmauth.Close: %v", err)
-	}
-	s.mmauth = nil
+	s.message.Close()
+	s.message = nil
 }
 
+// resetMessageState はメッセージごとの状態を破棄する
+// 接続元と HELO はセッションの間保持する
 func (s *Session) resetMessageState() {
-	s.closeMMAuth()
-	s.isARCSign = false
-	s.isDKIMSign = false
-	s.rcptToDomain = ""
-	s.mailFrom = ""
-	s.from = ""
-	s.fromDomain = ""
-	s.authn = ""
-	s.mmauth = mmauth.NewMMAuth()
+	s.closeMessage()
+	s.env.MailFrom = ""
+	s.env.Rcpts = nil
+	s.env.AuthUser = ""
 }
 
-func (s *Session) ensureMMAuth() {
-	if s.mmauth == nil {
-		s.mmauth = mmauth.NewMMAuth()
+// ensureMessage はヘッダの受信を開始した時点のエンベロープでメッセージの処理を開始する
+func (s *Session) ensureMessage() {
+	if s.message == nil {
+		s.message = signer.NewMessage(s.conf, s.listen, s.env)
 	}
 }
 
 func (s *Session) Connect(host string, family string, port uint16, addr string, m *milter.Modifier) (*milter.Response, error) {
 	s.debugLog("Connect: %s", addr)
 	if ip := net.ParseIP(addr); ip != nil {
-		s.remoteAddr = ip
+		s.env.RemoteAddr = ip
+	}
+	// 逆引きできなかった場合は "[192.0.2.1]" もしくは "unknown" が渡される
+	if host != "unknown" && !strings.HasPrefix(host, "[") {
+		s.env.Hostname = host
 	}
 	return milter.RespContinue, nil
 }
 
 func (s *Session) Helo(name string, m *milter.Modifier) (*milter.Response, error) {
 	s.debugLog("Helo: %s", name)
-	s.helo = name
+	s.env.Helo = name
 	return milter.RespContinue, nil
 }
 
 func (s *Session) MailFrom(from string, esmtpArgs string, m *milter.Modifier) (*milter.Response, error) {
 	s.resetMessageState()
-	s.authn = m.Macros.Get(milter.MacroAuthAuthen)
-	s.mailFrom = from
+	s.env.AuthUser = m.Macros.Get(milter.MacroAuthAuthen)
+	s.env.MailFrom = from
 	s.debugLog("MailFrom: %s", from)
 	return milter.RespContinue, nil
 }
 
 func (s *Session) RcptTo(rcptTo string, esmtpArgs string, m *milter.Modifier) (*milter.Response, error) {
 	s.debugLog("RcptTo: %s", rcptTo)
-	s.ensureMMAuth()
-
-	// SMTP 認証済みもしくは IP アドレスが MyNetworks に含まれている場合は署名を行わない
-	if s.authn != "" || s.conf.IsMyNetwork(s.remoteAddr) {
-		return milter.RespContinue, nil
-	}
-
-	rpctToDomain, err := mmauth.ParseAddressDomain(rcptTo)
-	if err != nil {
-		s.logError("util.ParseAddressDomain: %v", err)
-		return milter.RespContinue, nil
-	}
-
-	// 宛先が対象ドメインなら ARC 署名と BodyHash を設定
-	if domain, ok := s.conf.GetMatchingDomain(rpctToDomain); ok && domain.ARC && !s.isARCSign {
-		s.isARCSign = true
-		s.rcptToDomain = rpctToDomain
-		s.mmauth.AddBodyHash(
-			createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0),
-		)
-		return milter.RespContinue, nil
-	}
-
+	s.env.Rcpts = append(s.env.Rcpts, rcptTo)
 	return milter.RespContinue, nil
 }
 
 func (s *Session) Header(name, value string, m *milter.Modifier) (*milter.Response, error) {
-	s.ensureMMAuth()
-	if _, err := s.mmauth.Write([]byte(name + ": " + value + "\r\n")); err != nil {
-		s.logError("s.mmauth.Write: %v", err)
-	}
-
-	if strings.ToLower(name) != "from" {
-		return milter.RespContinue, nil
-	}
-
-	s.from = value
-	fromDomain, err := mmauth.ParseAddressDomain(value)
-	if err != nil {
-		s.logError("util.ParseAddressDomain: %v", err)
-		s.isDKIMSign = false
-		return milter.RespContinue, nil
-	}
-	s.fromDomain = fromDomain
-
-	// 送信元が対象ドメインなら DKIM 署名設定
-	if domain, ok := s.conf.GetMatchingDomain(s.fromDomain); ok && domain.DKIM {
-		s.mmauth.AddBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0))
-		s.isDKIMSign = true
-	} else {
-		s.isDKIMSign = false
-	}
-
+	s.ensureMessage()
+	s.message.AddHeader(name, value)
 	return milter.RespContinue, nil
 }
 
 func (s *Session) Headers(m *milter.Modifier) (*milter.Response, error) {
 	s.debugLog("Headers")
-	s.ensureMMAuth()
-	if _, err := s.mmauth.Write([]byte("\r\n")); err != nil {
-		s.logError("s.mmauth.Write: %v", err)
-	}
+	s.ensureMessage()
+	s.message.EndHeaders()
 	return milter.RespContinue, nil
 }
 
 func (s *Session) BodyChunk(chunk []byte, m *milter.Modifier) (*milter.Response, error) {
-	s.ensureMMAuth()
-	if _, err := s.mmauth.Write(chunk); err != nil {
-		s.logError("s.mmauth.Write: %v", err)
-	}
+	s.ensureMessage()
+	s.message.Write(chunk)
 	return milter.RespContinue, nil
 }
 
-// getKeyTypeAlgo は公開鍵のタイプから DKIM 署名アルゴリズムを判定する
-func getKeyTypeAlgo(pub interface{}) (dkim.SignatureAlgorithm, error) {
-	switch pub.(type) {
-	case *rsa.PublicKey:
-		return dkim.SignatureAlgorithmRSA_SHA256, nil
-	case ed25519.PublicKey:
-		return dkim.SignatureAlgorithmED25519_SHA256, nil
-	default:
-		return "", fmt.Errorf("unknown key type: %T", pub)
-	}
-}
-
-// createBodyHashConfig は BodyHash の設定用構造体を生成する
-func createBodyHashConfig(canonicalization string, hashAlgo crypto.Hash, limit int64) mmauth.BodyCanonicalizationAndAlgorithm {
-	return mmauth.BodyCanonicalizationAndAlgorithm{
-		Body:      mmauth.Canonicalization(canonicalization),
-		Algorithm: hashAlgo,
-		Limit:     limit,
-	}
-}
-
-func DKIMSign(s *Session, m *milter.Modifier) {
-	if !s.isDKIMSign {
-		return
-	}
-
-	if h := mmauth.ExtractHeadersDKIM(s.mmauth.Headers, []string{"DKIM-Signature"}); len(h) > 0 {
-		// すでに DKIM 署名がある場合は DKIM 署名しない
-		s.logError("DKIM-Signature found Skip")
-		return
-	}
-
-	// 対応するドメインのキーがある場合は DKIM 署名を行う
-	if domain, ok := s.conf.GetMatchingDomain(s.fromDomain); ok && domain.DKIM {
-		bodyHash := s.mmauth.GetBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0))
-		if bodyHash == "" {
-			s.logError("DKIM body hash is empty")
-			return
-		}
-
-		algo, err := getKeyTypeAlgo(domain.PrivateKeySigner.Public())
-		if err != nil {
-			s.logError("%v", err)
-			return
-		}
-
-		// DKIM 署名
-		dkim := dkim.Signature{
-			Algorithm:        algo,
-			Signature:        "",
-			BodyHash:         bodyHash,
-			Canonicalization: domain.HeaderCanonicalization + "/" + domain.BodyCanonicalization,
-			Domain:           domain.Domain,
-			Selector:         domain.Selector,
-			Version:          1,
-		}
-
-		if err := dkim.Sign(mmauth.ExtractHeadersDKIM(s.mmauth.Headers, s.conf.DKIMSignHeaders),
-			domain.PrivateKeySigner); err != nil {
-			s.logError("dkim.Sign: %v", err)
-			return
-		}
-
-		if err := m.InsertHeader(1, "DKIM-Signature", dkim.String()); err != nil {
-			s.logError("DKIM Signature Insert Error: %v", err)
-			return
-		}
-		s.mmauth.Headers = append(s.mmauth.Headers, "DKIM-Signature: "+dkim.String())
-	}
-}
-
-func ARCSign(s *Session, m *milter.Modifier) {
-	if !s.isARCSign {
-		return
-	}
-
-	if domain, ok := s.conf.GetMatchingDomain(s.rcptToDomain); ok && domain.ARC {
-		if s.mmauth.AuthenticationHeaders == nil {
-			s.logError("AuthenticationHeaders is nil")
-			return
-		}
-		ah := s.mmauth.AuthenticationHeaders.ARCSignatures
-
-		// ARC-Chain-Validation-Result が fail の場合は ARC 署名を行わない
-		if ah.GetARCChainValidation() == arc.ChainValidationResultFail {
-			s.logError("ARC-Chain-Validation-Result is fail skip ARC signing")
-			return
-		}
-
-		// 署名アルゴリズムの判定
-		var arcAlgo arc.SignatureAlgorithm
-		switch domain.PrivateKeySigner.Public().(type) {
-		case *rsa.PublicKey:
-			arcAlgo = arc.SignatureAlgorithmRSA_SHA256
-		case ed25519.PublicKey:
-			arcAlgo = arc.SignatureAlgorithmED25519_SHA256
-		default:
-			s.logError("unknown key type: %T", domain.PrivateKeySigner)
-			return
-		}
-
-		instanceNumber := ah.GetMaxInstance() + 1
-		signature := arc.ARCMessageSignature{
-			InstanceNumber:   instanceNumber,
-			Algorithm:        arcAlgo,
-			Domain:           s.rcptToDomain,
-			Selector:         domain.ARCSelector,
-			Canonicalization: domain.HeaderCanonicalization + "/" + domain.BodyCanonicalization,
-			BodyHash:         s.mmauth.GetBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0)),
-		}
-		if signature.BodyHash == "" {
-			s.logError("ARC body hash is empty")
-			return
-		}
-
-		if err := signature.Sign(mmauth.ExtractHeadersDKIM(s.mmauth.Headers, s.conf.ARCSignHeaders),
-			domain.PrivateKeySigner); err != nil {
-			s.logError("signature.Sign: %v", err)
-			return
-		}
-
-		results := s.mmauth.GetAuthenticationHeader(s.remoteAddr, s.helo, s.mailFrom)
-		result := arc.ARCAuthenticationResults{
-			InstanceNumber: instanceNumber,
-			AuthServId:     s.rcptToDomain,
-			Results:        results,
-		}
-
-		// ARC-Seal 署名
-		seal := arc.ARCSeal{
-			InstanceNumber: instanceNumber,
-			Algorithm:      arcAlgo,
-			Domain:         s.rcptToDomain,
-			Selector:       domain.ARCSelector,
-			ChainValidation: arc.ChainValidationResult(
-				s.mmauth.AuthenticationHeaders.ARCSignatures.GetVerifyResult(),
-			),
-		}
-		headers := s.mmauth.AuthenticationHeaders.ARCSignatures.GetARCHeaders()
-		headers = append(headers, "ARC-Authentication-Results: "+result.String())
-		headers = append(headers, "ARC-Message-Signature: "+signature.String())
-
-		if err := seal.Sign(headers, domain.PrivateKeySigner); err != nil {
-			s.logError("seal.Sign: %v", err)
-			return
-		}
-
-		if err := m.InsertHeader(1, "ARC-Authentication-Results", result.String()); err != nil {
-			s.logError("ARC-Authentication-Results Insert Error: %v", err)
-			return
-		}
-		if err := m.InsertHeader(1, "ARC-Message-Signature", signature.String()); err != nil {
-			s.logError("ARC-Message-Signature Insert Error: %v", err)
-			return
-		}
-		if err := m.InsertHeader(1, "ARC-Seal", seal.String()); err != nil {
-			s.logError("ARC-Seal Insert Error: %v", err)
-			return
-		}
-	}
-}
-
 func (s *Session) EndOfMessage(m *milter.Modifier) (*milter.Response, error) {
 	s.debugLog("EndOfMessage")
-	if s.mmauth == nil {
+	if s.message == nil {
 		return milter.RespContinue, nil
 	}
-	if err := s.mmauth.Close(); err != nil {
-		s.logError("s.mmauth.Close: %v", err)
-		s.mmauth = nil
+	headers, err := s.message.Sign()
+	s.debugLog("session: %s", pp.Sprint(s))
+	s.message = nil
+	if err != nil {
+		s.logError("%v", err)
 		return milter.RespContinue, nil
 	}
 
-	// Verify
-	s.mmauth.Verify()
-
-	// DKIM 署名
-	DKIMSign(s, m)
-
-	// ARC 署名
-	ARCSign(s, m)
-
-	s.debugLog("session: %s", pp.Sprint(s))
-	s.mmauth = nil
+	// 追加するヘッダを先頭から順に並べるため、後ろのヘッダから順に先頭へ挿入する
+	for i := len(headers) - 1; i >= 0; i-- {
+		if err := m.InsertHeader(1, headers[i].Name, headers[i].Value); err != nil {
+			s.logError("%s Insert Error: %v", headers[i].Name, err)
+			return milter.RespContinue, nil
+		}
+	}
 
 	return milter.RespContinue, nil
 }
@@ -393,19 +210,12 @@ func (s *Session) EndOfMessage(m *milter.Modifier) (*milter.Response, error) {
 func (s *Session) Abort(_ *milter.Modifier) error {
 	s.debugLog("Abort")
 
-	s.closeMMAuth()
-	s.isARCSign = false
-	s.isDKIMSign = false
-	s.rcptToDomain = ""
-	s.mailFrom = ""
-	s.from = ""
-	s.fromDomain = ""
-	s.authn = ""
+	s.resetMessageState()
 	return nil
 }
 
 func (s *Session) Cleanup() {
 	s.debugLog("Cleanup")
 
-	s.closeMMAuth()
+	s.closeMessage()
 }
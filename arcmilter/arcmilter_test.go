@@ -0,0 +1,45 @@
+package arcmilter
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+func Test_Serve(t *testing.T) {
+	listens := []config.MilterListen{{Network: "tcp", Address: "127.0.0.1:0", Policy: config.ListenPolicyBoth}}
+	startup := &config.Config{MilterListens: listens}
+	reloaded := &config.Config{MilterListens: listens}
+
+	// SetConfig を呼び出す前は待ち受けを開始しない
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if err := New(nil).Serve(l, startup, 0); err == nil {
+		t.Fatalf("expected error without config")
+	}
+	l.Close()
+
+	// 待ち受けの開始前に再読み込みされた設定を起動時の設定で上書きしない
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	a := New(nil)
+	a.SetConfig(reloaded)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- a.Serve(l, startup, 0)
+	}()
+	if err := a.WaitAccepting(1, 5*time.Second); err != nil {
+		t.Fatalf("failed to wait accepting: %v", err)
+	}
+	if a.conf.Load() != reloaded {
+		t.Errorf("config was replaced by Serve")
+	}
+	l.Close()
+	<-errCh
+}
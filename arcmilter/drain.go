@@ -0,0 +1,88 @@
+package arcmilter
+
+import (
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// drainPollInterval は処理中のセッション数を確認する間隔
+const drainPollInterval = 100 * time.Millisecond
+
+// trackedListener は受け付けた接続の数を数える
+// 最初に Accept が呼ばれた時点で accepting を増やし、待ち受けを開始したことを示す
+type trackedListener struct {
+	net.Listener
+	a    *ARCMilter
+	once sync.Once
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	l.once.Do(func() {
+		l.a.accepting.Add(1)
+	})
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.a.active.Add(1)
+	if n := l.a.served.Add(1); l.a.maxSessions > 0 && n == l.a.maxSessions {
+		go l.a.onMaxSessions()
+	}
+	return &trackedConn{Conn: conn, active: &l.a.active}, nil
+}
+
+// trackedConn は Close された時に処理中の接続数を減らす
+type trackedConn struct {
+	net.Conn
+	active *atomic.Int64
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+// SetMaxSessions は受け付けたセッションの数が n に達した時に fn を一度だけ呼び出すよう設定する
+// Serve を呼び出す前に設定する必要がある
+func (a *ARCMilter) SetMaxSessions(n int64, fn func()) {
+	a.maxSessions = n
+	a.onMaxSessions = fn
+}
+
+// ActiveSessions は処理中の milter セッションの数を返す
+func (a *ARCMilter) ActiveSessions() int64 {
+	return a.active.Load()
+}
+
+// Drain は処理中の milter セッションが全て終了するまで最大 timeout 待つ
+// 待ち受けは先に閉じておく必要がある
+// 全てのセッションが終了した場合は true を返す
+func (a *ARCMilter) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		active := a.ActiveSessions()
+		if active <= 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			log.Printf("drain timed out with %d active sessions pid=%d", active, os.Getpid())
+			return false
+		}
+		// 1秒ごとに進捗を出力
+		if time.Since(lastLog) >= time.Second {
+			log.Printf("draining %d active sessions pid=%d", active, os.Getpid())
+			lastLog = time.Now()
+		}
+		<-ticker.C
+	}
+}
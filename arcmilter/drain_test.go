@@ -0,0 +1,105 @@
+package arcmilter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Drain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	a := New(nil)
+	l := &trackedListener{Listener: ln, a: a}
+	defer l.Close()
+
+	// 2つの接続を受け付ける
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	if n := a.ActiveSessions(); n != 2 {
+		t.Fatalf("expected 2 active sessions, got %d", n)
+	}
+
+	// セッションが残っている場合はタイムアウトする
+	if a.Drain(200 * time.Millisecond) {
+		t.Fatalf("expected drain to time out")
+	}
+
+	// 複数回 Close しても数は1回だけ減る
+	conns[0].Close()
+	conns[0].Close()
+	if n := a.ActiveSessions(); n != 1 {
+		t.Fatalf("expected 1 active session, got %d", n)
+	}
+
+	// 処理中のセッションが終了すると Drain も終了する
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conns[1].Close()
+	}()
+	if !a.Drain(5 * time.Second) {
+		t.Fatalf("expected drain to complete")
+	}
+	if n := a.ActiveSessions(); n != 0 {
+		t.Fatalf("expected 0 active sessions, got %d", n)
+	}
+}
+
+func Test_SetMaxSessions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	a := New(nil)
+	called := make(chan struct{}, 3)
+	a.SetMaxSessions(2, func() {
+		called <- struct{}{}
+	})
+	l := &trackedListener{Listener: ln, a: a}
+	defer l.Close()
+
+	// 3つの接続を受け付けても2つ目の接続で一度だけ呼び出される
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer client.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+		defer conn.Close()
+		if i == 0 {
+			select {
+			case <-called:
+				t.Fatalf("called before reaching the limit")
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+	}
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("not called after reaching the limit")
+	}
+	select {
+	case <-called:
+		t.Fatalf("called more than once")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,206 @@
+package arcmilter
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/smtpbackend"
+)
+
+const (
+	// smtpTimeout は SMTP のコマンドを待つ時間
+	smtpTimeout = 5 * time.Minute
+	// nextHopDialTimeout は NextHop への接続を待つ時間
+	nextHopDialTimeout = 30 * time.Second
+)
+
+// errNextHopUnavailable は NextHop に接続できない場合に SMTP クライアントに返すエラー
+var errNextHopUnavailable = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+	Message:      "Next hop is not available",
+}
+
+// serveSMTP は l で SMTP の接続を受け付け、署名したメッセージを NextHop に中継する
+func (a *ARCMilter) serveSMTP(l net.Listener, listen config.MilterListen, index int) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	server := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		// セッション開始時点の設定を使い続ける
+		conf := a.conf.Load()
+		// 再読み込みで待ち受けが減った場合は起動時の設定を使う
+		l := &listen
+		if index < len(conf.MilterListens) {
+			l = &conf.MilterListens[index]
+		}
+		relay := &relayBackend{conf: conf, listen: l, hostname: hostname}
+		return smtpbackend.New(relay, conf, l).NewSession(c)
+	}))
+	server.Domain = hostname
+	server.ReadTimeout = smtpTimeout
+	server.WriteTimeout = smtpTimeout
+	server.ErrorLog = log.Default()
+	log.Printf("Start SMTP proxy server %s:%s next-hop=%s policy=%s", listen.Network, listen.Address, listen.NextHop, listen.Policy)
+	// Close は処理中のセッションを切断するため呼び出さず、Drain でセッションの終了を待つ
+	return server.Serve(&trackedListener{Listener: l, a: a})
+}
+
+// relayBackend は受け付けたメッセージを NextHop に中継する
+type relayBackend struct {
+	conf     *config.Config
+	listen   *config.MilterListen
+	hostname string
+}
+
+func (b *relayBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &relaySession{
+		backend: b,
+		trusted: b.isTrusted(c.Conn().RemoteAddr()),
+	}, nil
+}
+
+// isTrusted は接続元が MAIL FROM の AUTH= を信頼できる MTA かを返す
+// UNIX ドメインソケットと MyNetworks、InternalHosts に含まれる接続元を信頼する
+func (b *relayBackend) isTrusted(addr net.Addr) bool {
+	if b.listen.Network == "unix" {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	return b.conf.IsInternalHost(net.ParseIP(host), "")
+}
+
+// relaySession は SMTP のコマンドを NextHop にそのまま中継する
+// NextHop の応答をクライアントに返すため、宛先ごとの拒否もそのまま伝わる
+type relaySession struct {
+	backend  *relayBackend
+	trusted  bool
+	client   *smtp.Client
+	authUser string
+}
+
+func (s *relaySession) logError(format string, v ...interface{}) {
+	log.Printf("arcmilter: "+format, v...)
+}
+
+// AuthUser は信頼できる MTA が MAIL FROM の AUTH= で渡した SMTP 認証のユーザー名を返す
+func (s *relaySession) AuthUser() string {
+	return s.authUser
+}
+
+// dial は NextHop に接続していなければ接続する
+func (s *relaySession) dial() error {
+	if s.client != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", s.backend.listen.NextHop, nextHopDialTimeout)
+	if err != nil {
+		s.logError("failed to connect next hop %s: %v", s.backend.listen.NextHop, err)
+		return errNextHopUnavailable
+	}
+	client := smtp.NewClient(conn)
+	if err := client.Hello(s.backend.hostname); err != nil {
+		client.Close()
+		s.logError("failed to greet next hop %s: %v", s.backend.listen.NextHop, err)
+		return errNextHopUnavailable
+	}
+	s.client = client
+	return nil
+}
+
+// closeClient は NextHop との接続を切断する
+func (s *relaySession) closeClient() {
+	if s.client == nil {
+		return
+	}
+	s.client.Close()
+	s.client = nil
+}
+
+// relayError は NextHop の応答をそのままクライアントに返す
+// 接続が切れた場合など応答を得られなかった場合は接続を破棄して一時的なエラーを返す
+func (s *relaySession) relayError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*smtp.SMTPError); ok {
+		return err
+	}
+	s.logError("failed to relay to next hop %s: %v", s.backend.listen.NextHop, err)
+	s.closeClient()
+	return errNextHopUnavailable
+}
+
+func (s *relaySession) Reset() {
+	s.authUser = ""
+	if s.client == nil {
+		return
+	}
+	if err := s.client.Reset(); err != nil {
+		s.logError("failed to reset next hop: %v", err)
+		s.closeClient()
+	}
+}
+
+func (s *relaySession) Logout() error {
+	if s.client == nil {
+		return nil
+	}
+	if err := s.client.Quit(); err != nil {
+		s.client.Close()
+	}
+	s.client = nil
+	return nil
+}
+
+func (s *relaySession) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.dial(); err != nil {
+		return err
+	}
+	s.authUser = ""
+	var o smtp.MailOptions
+	if opts != nil {
+		o = *opts
+		// 署名によりメッセージの大きさが変わるため SIZE は渡さない
+		o.Size = 0
+		if !s.trusted {
+			o.Auth = nil
+		}
+		if o.Auth != nil {
+			s.authUser = *o.Auth
+		}
+	}
+	return s.relayError(s.client.Mail(from, &o))
+}
+
+func (s *relaySession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if s.client == nil {
+		return errNextHopUnavailable
+	}
+	return s.relayError(s.client.Rcpt(to, opts))
+}
+
+func (s *relaySession) Data(r io.Reader) error {
+	if s.client == nil {
+		io.Copy(io.Discard, r)
+		return errNextHopUnavailable
+	}
+	w, err := s.client.Data()
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return s.relayError(err)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return s.relayError(err)
+	}
+	return s.relayError(w.Close())
+}
@@ -0,0 +1,210 @@
+package arcmilter
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/masa23/arcmilter/config"
+)
+
+// sinkSession は中継されたメッセージを記録する SMTP サーバーのセッション
+type sinkSession struct {
+	messages chan string
+}
+
+func (s *sinkSession) Reset()        {}
+func (s *sinkSession) Logout() error { return nil }
+func (s *sinkSession) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if strings.HasPrefix(to, "reject@") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "rejected"}
+	}
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.messages <- string(data)
+	return nil
+}
+
+// startSink は中継先の SMTP サーバーを起動してアドレスを返す
+func startSink(t *testing.T, messages chan string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &sinkSession{messages: messages}, nil
+	}))
+	server.Domain = "localhost"
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return l.Addr().String()
+}
+
+func Test_serveSMTP(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	domains := map[string]config.Domain{
+		"example.jp": {
+			HeaderCanonicalization: "relaxed",
+			BodyCanonicalization:   "relaxed",
+			HashAlgo:               crypto.SHA256,
+			Domain:                 "example.jp",
+			Selector:               "default",
+			PrivateKeySigner:       key,
+			DKIM:                   true,
+			DKIMSignHeaders:        []string{"From", "To", "Subject"},
+			ResignPolicy:           config.ResignPolicyAlways,
+		},
+	}
+	loopback, err := config.ParseNetworks("MyNetworks", []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("failed to parse networks: %v", err)
+	}
+	message := "From: test@example.com\r\nTo: user@example.jp\r\nSubject: test\r\n\r\ntest message\r\n"
+
+	testCases := []struct {
+		name         string
+		myNetworks   config.Networks
+		auth         string
+		rcpts        []string
+		expectedCode int
+		expectedDKIM bool
+	}{
+		{
+			name:         "AUTH from trusted MTA",
+			myNetworks:   loopback,
+			auth:         "user@example.jp",
+			rcpts:        []string{"user@example.jp"},
+			expectedDKIM: true,
+		},
+		{
+			name:  "AUTH from untrusted client",
+			auth:  "user@example.jp",
+			rcpts: []string{"user@example.jp"},
+		},
+		{
+			name:         "recipient rejected by next hop",
+			myNetworks:   loopback,
+			auth:         "user@example.jp",
+			rcpts:        []string{"reject@example.jp"},
+			expectedCode: 550,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			messages := make(chan string, 1)
+			conf := &config.Config{
+				PartialBodyPolicy: config.PartialBodyPolicyAccept,
+				ParsedMyNetworks:  tc.myNetworks,
+				AuthDomains:       map[string]string{"user@example.jp": "example.jp"},
+				Domains:           domains,
+				MilterListens: []config.MilterListen{
+					{
+						Network:           "tcp",
+						Address:           "127.0.0.1:0",
+						SigningIdentities: []string{config.SigningIdentityAuth},
+						Policy:            config.ListenPolicySign,
+						Protocol:          config.ListenProtocolSMTP,
+						NextHop:           startSink(t, messages),
+					},
+				},
+			}
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			a := New(nil)
+			a.SetConfig(conf)
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- a.Serve(l, conf, 0)
+			}()
+
+			// go-smtp のクライアントは AUTH を広告しないサーバーに AUTH= を送らないため直接コマンドを送る
+			c, err := textproto.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer c.Close()
+			cmd := func(expectCode int, format string, args ...interface{}) error {
+				id, err := c.Cmd(format, args...)
+				if err != nil {
+					return err
+				}
+				c.StartResponse(id)
+				defer c.EndResponse(id)
+				_, _, err = c.ReadResponse(expectCode)
+				return err
+			}
+			if _, _, err := c.ReadResponse(220); err != nil {
+				t.Fatalf("failed to read greeting: %v", err)
+			}
+			if err := cmd(250, "EHLO client.example.jp"); err != nil {
+				t.Fatalf("failed to send EHLO: %v", err)
+			}
+			if err := cmd(250, "MAIL FROM:<test@example.com> AUTH=%s", tc.auth); err != nil {
+				t.Fatalf("failed to send MAIL: %v", err)
+			}
+			for _, rcpt := range tc.rcpts {
+				expectCode := 250
+				if tc.expectedCode != 0 {
+					expectCode = tc.expectedCode
+				}
+				if err := cmd(expectCode, "RCPT TO:<%s>", rcpt); err != nil {
+					t.Fatalf("unexpected RCPT response: %v", err)
+				}
+			}
+			if tc.expectedCode == 0 {
+				if err := cmd(354, "DATA"); err != nil {
+					t.Fatalf("failed to send DATA: %v", err)
+				}
+				w := c.DotWriter()
+				io.WriteString(w, strings.ReplaceAll(message, "\r\n", "\n"))
+				w.Close()
+				if _, _, err := c.ReadResponse(250); err != nil {
+					t.Fatalf("failed to send message: %v", err)
+				}
+				received := <-messages
+				if !strings.HasSuffix(received, message) {
+					t.Errorf("original message is modified: %q", received)
+				}
+				if signed := strings.HasPrefix(received, "DKIM-Signature:"); signed != tc.expectedDKIM {
+					t.Errorf("expected DKIM signature %t, got %q", tc.expectedDKIM, received)
+				}
+			}
+			cmd(221, "QUIT")
+
+			// 待ち受けを閉じると Serve が終了し、セッションの終了を Drain で待てる
+			l.Close()
+			if err := <-errCh; !errors.Is(err, net.ErrClosed) {
+				t.Errorf("expected net.ErrClosed, got %v", err)
+			}
+			if !a.Drain(5 * time.Second) {
+				t.Errorf("expected drain to complete")
+			}
+		})
+	}
+}
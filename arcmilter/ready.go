@@ -0,0 +1,89 @@
+package arcmilter
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+// WaitAccepting は n 個の待ち受けが接続の受け付けを開始するまで最大 timeout 待つ
+func (a *ARCMilter) WaitAccepting(n int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		accepting := a.accepting.Load()
+		if accepting >= int64(n) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("only %d of %d listeners started accepting", accepting, n)
+		}
+		<-ticker.C
+	}
+}
+
+// SelfCheck は署名を行う各ドメインの秘密鍵で試験的に署名し、署名に使用できることを確認する
+// 同じ鍵ファイルを使うドメインは1回だけ確認する
+func SelfCheck(conf *config.Config) error {
+	patterns := make([]string, 0, len(conf.Domains))
+	for pattern := range conf.Domains {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	checked := make(map[string]bool)
+	for _, pattern := range patterns {
+		domain := conf.Domains[pattern]
+		if !domain.DKIM && !domain.ARC {
+			continue
+		}
+		if domain.PrivateKeySigner == nil {
+			return fmt.Errorf("Domains[%s]: private key is not loaded", pattern)
+		}
+		if domain.PrivateKeyFile != "" && checked[domain.PrivateKeyFile] {
+			continue
+		}
+		if err := selfCheckKey(domain.PrivateKeySigner); err != nil {
+			return fmt.Errorf("Domains[%s]: %v", pattern, err)
+		}
+		if domain.PrivateKeyFile != "" {
+			checked[domain.PrivateKeyFile] = true
+		}
+	}
+	return nil
+}
+
+// selfCheckKey は signer で署名し、その公開鍵で検証できることを確認する
+func selfCheckKey(signer crypto.Signer) error {
+	digest := sha256.Sum256([]byte("arcmilter self-check"))
+	switch pub := signer.Public().(type) {
+	case *rsa.PublicKey:
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			return fmt.Errorf("failed to test sign: %v", err)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			return fmt.Errorf("failed to verify test signature: %v", err)
+		}
+	case ed25519.PublicKey:
+		sig, err := signer.Sign(rand.Reader, digest[:], crypto.Hash(0))
+		if err != nil {
+			return fmt.Errorf("failed to test sign: %v", err)
+		}
+		if !ed25519.Verify(pub, digest[:], sig) {
+			return errors.New("failed to verify test signature")
+		}
+	default:
+		return fmt.Errorf("unknown key type: %T", pub)
+	}
+	return nil
+}
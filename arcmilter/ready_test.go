@@ -0,0 +1,168 @@
+package arcmilter
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+// mismatchSigner は公開鍵と異なる秘密鍵で署名する
+type mismatchSigner struct {
+	crypto.Signer
+	public crypto.PublicKey
+}
+
+func (s *mismatchSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+// unknownSigner は対応していない種類の公開鍵を返す
+type unknownSigner struct{}
+
+func (unknownSigner) Public() crypto.PublicKey {
+	return "unknown"
+}
+
+func (unknownSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, nil
+}
+
+func Test_selfCheckKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+	otherEdPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		signer    crypto.Signer
+		expectErr bool
+	}{
+		{
+			name:   "rsa",
+			signer: rsaKey,
+		},
+		{
+			name:   "ed25519",
+			signer: edKey,
+		},
+		{
+			name:      "rsa public key mismatch",
+			signer:    &mismatchSigner{Signer: rsaKey, public: otherKey.Public()},
+			expectErr: true,
+		},
+		{
+			name:      "ed25519 public key mismatch",
+			signer:    &mismatchSigner{Signer: edKey, public: otherEdPub},
+			expectErr: true,
+		},
+		{
+			name:      "unknown key type",
+			signer:    unknownSigner{},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := selfCheckKey(tc.signer)
+			if (err != nil) != tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_SelfCheck(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		domains   map[string]config.Domain
+		expectErr bool
+	}{
+		{
+			name: "usable keys",
+			domains: map[string]config.Domain{
+				"example.jp":  {DKIM: true, PrivateKeyFile: "example.jp.key", PrivateKeySigner: key},
+				"example.com": {ARC: true, PrivateKeyFile: "example.jp.key", PrivateKeySigner: key},
+			},
+		},
+		{
+			name: "signing disabled",
+			domains: map[string]config.Domain{
+				"example.jp": {},
+			},
+		},
+		{
+			name: "key is not loaded",
+			domains: map[string]config.Domain{
+				"example.jp": {DKIM: true},
+			},
+			expectErr: true,
+		},
+		{
+			name: "unusable key",
+			domains: map[string]config.Domain{
+				"example.jp": {DKIM: true, PrivateKeyFile: "example.jp.key", PrivateKeySigner: unknownSigner{}},
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := SelfCheck(&config.Config{Domains: tc.domains})
+			if (err != nil) != tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func Test_WaitAccepting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	a := New(nil)
+	l := &trackedListener{Listener: ln, a: a}
+	defer l.Close()
+
+	// Accept が呼ばれるまでは準備完了にならない
+	if err := a.WaitAccepting(1, 200*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout before accepting")
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	if err := a.WaitAccepting(1, 5*time.Second); err != nil {
+		t.Fatalf("failed to wait accepting: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/masa23/arcmilter/arcmilter"
+	"github.com/masa23/arcmilter/control"
+)
+
+// runForeground は親プロセスと子プロセスに分けずに1つのプロセスで milter を処理する
+// コンテナでの利用を想定し、ログは標準出力に出力する
+// PIDファイルと control ソケットは設定されている場合のみ作成する
+func runForeground() {
+	conf := currentConf.Load()
+	conf.LogFd = os.Stdout
+	log.SetOutput(conf.LogFd)
+
+	if conf.PidFile.Path != "" {
+		if err := checkPidFile(conf.PidFile.Path); err != nil {
+			log.Fatalf("Failed to check pid file: %v", err)
+		}
+	}
+
+	// systemd のソケットアクティベーションで渡されたソケットを MilterListens の順に使う
+	files, err := systemdListenFiles()
+	if err != nil {
+		log.Fatalf("Failed to get sockets from systemd: %v", err)
+	}
+	if len(files) > 0 && len(files) != len(conf.MilterListens) {
+		log.Fatalf("Number of sockets from systemd %d does not match MilterListens %d", len(files), len(conf.MilterListens))
+	}
+	if len(files) == 0 {
+		for _, listen := range conf.MilterListens {
+			file, err := listenMilter(listen)
+			if err != nil {
+				log.Fatalf("Failed to listen %s:%s: %v", listen.Network, listen.Address, err)
+			}
+			files = append(files, file)
+		}
+	}
+	listeners := make([]net.Listener, 0, len(files))
+	for _, file := range files {
+		socket, err := net.FileListener(file)
+		if err != nil {
+			log.Fatalf("Failed to get socket: %v", err)
+		}
+		file.Close()
+		listeners = append(listeners, socket)
+	}
+
+	server := arcmilter.New(nil)
+	server.SetDebug(conf.Debug)
+	server.SetClock(signClock)
+	// 待ち受けの開始と再読み込みの前に設定する
+	server.SetConfig(conf)
+
+	// control ソケットではドメイン設定と鍵の再読み込みのみを受け付ける
+	if conf.ControlSocketFile.Path != "" {
+		csocket, err := listenControl()
+		if err != nil {
+			log.Fatalf("Failed to listen control socket: %v", err)
+		}
+		defer csocket.Close()
+		controller = control.New(func(int) {})
+		controller.HandleReload(func() error {
+			return reloadForeground(server)
+		})
+		go func() {
+			if err := controller.Serve(csocket); err != nil {
+				log.Fatalf("Failed to serve control socket: %v", err)
+			}
+		}()
+	}
+
+	// 権限を変更
+	if err := syscall.Setgid(conf.Gid); err != nil {
+		log.Fatalf("Failed to set gid: %v", err)
+	}
+	if err := syscall.Setuid(conf.Uid); err != nil {
+		log.Fatalf("Failed to set uid: %v", err)
+	}
+
+	if conf.Debug {
+		log.Printf("config: %+v", conf)
+	}
+
+	// 新しい接続の受け付けを止める
+	var closeOnce sync.Once
+	closeListeners := func() {
+		closeOnce.Do(func() {
+			for _, socket := range listeners {
+				if err := socket.Close(); err != nil {
+					log.Printf("failed to close socket: %v", err)
+				}
+			}
+		})
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
+		for {
+			switch <-sig {
+			case syscall.SIGHUP, syscall.SIGUSR1:
+				// 待ち受けはそのままで設定と鍵を再読み込み
+				if err := reloadForeground(server); err != nil {
+					log.Printf("failed to reload: %v", err)
+				}
+			case syscall.SIGTERM, syscall.SIGINT:
+				log.Printf("received signal closing socket pid=%d active sessions=%d", os.Getpid(), server.ActiveSessions())
+				notifySystemd("STOPPING=1", "STATUS=stopping")
+				closeListeners()
+			}
+		}
+	}()
+
+	go func() {
+		if err := server.WaitAccepting(len(listeners), childReadyTimeout); err != nil {
+			log.Fatalf("Failed to start milter: %v", err)
+		}
+		if err := arcmilter.SelfCheck(currentConf.Load()); err != nil {
+			log.Fatalf("Self-check failed: %v", err)
+		}
+		log.Printf("ready pid=%d", os.Getpid())
+		notifySystemd("READY=1", fmt.Sprintf("STATUS=ready pid=%d", os.Getpid()), fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	}()
+
+	errCh := make(chan error, len(listeners))
+	for i, socket := range listeners {
+		go func(i int, socket net.Listener) {
+			errCh <- server.Serve(socket, conf, i)
+		}(i, socket)
+	}
+	for range listeners {
+		if err := <-errCh; err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("Failed to serve milter: %v", err)
+		}
+	}
+
+	// 処理中のセッションが終わるまで待つ
+	if server.Drain(currentConf.Load().ShutdownTimeoutDuration) {
+		log.Printf("drained pid=%d", os.Getpid())
+	}
+	if conf.PidFile.Path != "" {
+		if err := os.Remove(conf.PidFile.Path); err != nil {
+			log.Printf("failed to remove pid file: %v", err)
+		}
+	}
+}
+
+// reloadForeground はフォアグラウンドモードで設定と鍵を再読み込みする
+// 待ち受けのアドレスと LogFile の変更は反映しない
+func reloadForeground(server *arcmilter.ARCMilter) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if err := reloadConfig(server); err != nil {
+		return err
+	}
+	log.Printf("config reloaded pid=%d", os.Getpid())
+	return nil
+}
+
+// listenControl は control ソケットを作成する
+func listenControl() (net.Listener, error) {
+	conf := currentConf.Load()
+	// scoketが存在していたら削除
+	if err := os.Remove(conf.ControlSocketFile.Path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove socket: %v", err)
+	}
+	csocket, err := net.Listen("unix", conf.ControlSocketFile.Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen socket: %v", err)
+	}
+	// socketのパーミッションを変更
+	if err := os.Chmod(conf.ControlSocketFile.Path, fs.FileMode(conf.ControlSocketFile.Mode)); err != nil {
+		csocket.Close()
+		return nil, fmt.Errorf("failed to change socket permission: %v", err)
+	}
+	return csocket, nil
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -23,18 +24,38 @@ import (
 )
 
 var (
-	version  = "dev"
-	conf     *config.Config
-	childlen []child
-	childMu  sync.Mutex
-	msockfd  *os.File
+	version    = "dev"
+	childlen   []child
+	childMu    sync.Mutex
+	msockfds   []*os.File
+	controller *control.Control
+	reloadMu   sync.Mutex
+	// 停止処理中は終了した子プロセスを再起動しない
+	shuttingDown atomic.Bool
+	// 子プロセスの異常終了と再起動の履歴
+	restarts restartTracker
+	// SIGHUP による子プロセスの入れ替え中は個々の子プロセスの準備完了を systemd に通知しない
+	reloading atomic.Bool
+	// 現在の設定 (再読み込みで差し替えるため、使用する際は Load した値を使う)
+	currentConf atomic.Pointer[config.Config]
+	// 子プロセスが親プロセスの読み込んだ秘密鍵を受け取るための接続 (フォアグラウンドモードでは nil)
+	parentKeys *rpc.Client
+	// 署名時刻の取得に使用する時計 (nil の場合は現在時刻を使用する)
+	signClock func() time.Time
 )
 
 const childReadyTimeout = 10 * time.Second
 
+// childExitGrace は ShutdownTimeout を過ぎた子プロセスが終了するまで追加で待つ時間
+const childExitGrace = 5 * time.Second
+
 type child struct {
 	Process *os.Process
 	Ready   bool
+	// 準備に失敗した理由
+	Failed string
+	// 入れ替えのために終了させている (終了しても再起動しない)
+	Stopping bool
 }
 
 // PIDファイルを確認して、存在していたら終了する
@@ -112,37 +133,131 @@ func markChildReady(pid int) {
 	}
 }
 
-func setChildrenReady(ready bool) {
+func markChildFailed(pid int, reason string) {
 	childMu.Lock()
 	defer childMu.Unlock()
-	for i := range childlen {
-		childlen[i].Ready = ready
+	for i, c := range childlen {
+		if c.Process.Pid == pid {
+			childlen[i].Failed = reason
+			break
+		}
 	}
 }
 
-func restoreChildrenReady(children []child) {
+func markChildStopping(pid int) {
 	childMu.Lock()
 	defer childMu.Unlock()
-	readyByPid := make(map[int]bool, len(children))
-	for _, c := range children {
-		readyByPid[c.Process.Pid] = c.Ready
-	}
 	for i, c := range childlen {
-		if ready, ok := readyByPid[c.Process.Pid]; ok {
-			childlen[i].Ready = ready
+		if c.Process.Pid == pid {
+			childlen[i].Stopping = true
+			break
+		}
+	}
+}
+
+// findChild は pid の子プロセスの状態を返す
+// 終了済みの場合は false を返す
+func findChild(pid int) (child, bool) {
+	childMu.Lock()
+	defer childMu.Unlock()
+	for _, c := range childlen {
+		if c.Process.Pid == pid {
+			return c, true
 		}
 	}
+	return child{}, false
 }
 
-func hasReadyChild() bool {
+// activeChildren は入れ替えのために終了させていない子プロセスを返す
+func activeChildren() []child {
 	childMu.Lock()
 	defer childMu.Unlock()
+	var children []child
 	for _, c := range childlen {
+		if !c.Stopping {
+			children = append(children, c)
+		}
+	}
+	return children
+}
+
+// waitChildReady は子プロセスが準備完了になるまで最大 timeout 待つ
+func waitChildReady(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		c, ok := findChild(pid)
+		if !ok {
+			return fmt.Errorf("child process exited pid=%d", pid)
+		}
+		if c.Failed != "" {
+			return fmt.Errorf("child process failed pid=%d: %s", pid, c.Failed)
+		}
 		if c.Ready {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for child process readiness pid=%d", pid)
+		}
+		<-ticker.C
+	}
+}
+
+// retireChild は子プロセスに SIGTERM を送る
+// 子プロセスは処理中のセッションが終わるまで ShutdownTimeout の間待ってから終了し、再起動はしない
+func retireChild(p *os.Process) {
+	conf := currentConf.Load()
+	markChildStopping(p.Pid)
+	log.Printf("draining child process pid=%d timeout=%s", p.Pid, conf.ShutdownTimeoutDuration)
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		log.Printf("failed to send signal to child process: %v", err)
+	}
+}
+
+// rollChildren は子プロセスを1つずつ新しい設定の子プロセスに入れ替える
+// 新しい子プロセスが準備完了になってから古い子プロセスを終了させる
+// Workers が変更された場合は子プロセスの数も合わせる
+func rollChildren() error {
+	conf := currentConf.Load()
+	oldChildren := activeChildren()
+	for i := 0; i < len(oldChildren) || i < conf.Workers; i++ {
+		if i < conf.Workers {
+			newChild := execChildProcess(conf.LogFd, msockfds)
+			if err := waitChildReady(newChild.Pid, childReadyTimeout); err != nil {
+				retireChild(newChild)
+				return fmt.Errorf("%v; replaced %d of %d child processes", err, i, len(oldChildren))
+			}
+		}
+		if i < len(oldChildren) {
+			retireChild(oldChildren[i].Process)
+		}
+	}
+	return nil
+}
+
+// waitChildren は子プロセスが全て終了するまで最大 timeout 待つ
+// 全ての子プロセスが終了した場合は true を返す
+func waitChildren(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	lastLog := time.Now()
+	for {
+		n := childCount()
+		if n == 0 {
 			return true
 		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		// 1秒ごとに進捗を出力
+		if time.Since(lastLog) >= time.Second {
+			log.Printf("waiting for %d child processes to exit", n)
+			lastLog = time.Now()
+		}
+		<-ticker.C
 	}
-	return false
 }
 
 func childrenSnapshot() []child {
@@ -153,7 +268,9 @@ func childrenSnapshot() []child {
 	return children
 }
 
-func openLogFile() error {
+// openLogFile は conf の LogFile を開いて conf.LogFd に設定し、以前の LogFd を閉じる
+// 再読み込みの際は差し替える前の新しい設定に対して呼び出す
+func openLogFile(conf *config.Config) error {
 	if conf.LogFile.Path != "" {
 		fd, err := os.OpenFile(conf.LogFile.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, fs.FileMode(conf.LogFile.Mode))
 		if err != nil {
@@ -175,102 +292,254 @@ func openLogFile() error {
 	return nil
 }
 
+// reloadDomains は設定ファイルを検証し、子プロセスにドメイン設定と鍵の再読み込みを指示する
+// 子プロセスの再起動は行わない
+func reloadDomains() error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	conf := currentConf.Load()
+	newConf, err := loadReloadConfig(conf, config.Load)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %v path=%s", err, conf.Path)
+	}
+	// ログファイルを引き継ぐ
+	newConf.LogFd = conf.LogFd
+	currentConf.Store(newConf)
+	generation := controller.NotifyReload()
+	log.Printf("reload requested generation=%d", generation)
+	notifySystemd(fmt.Sprintf("STATUS=domains reload requested generation=%d", generation))
+	return nil
+}
+
+// requestReload は起動中の親プロセスに control ソケット経由で再読み込みを要求する
+func requestReload(path string) error {
+	ctrl, err := rpc.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect control socket: %v", err)
+	}
+	defer ctrl.Close()
+	return ctrl.Call("Control.Reload", struct{}{}, &struct{}{})
+}
+
 func checkSignal() {
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGUSR1)
 	for {
 		switch <-sig {
+		case syscall.SIGUSR1:
+			// 子プロセスを再起動せずにドメイン設定と鍵を再読み込み
+			if err := reloadDomains(); err != nil {
+				log.Printf("failed to reload: %v", err)
+			}
 		case syscall.SIGHUP:
+			notifySystemd("RELOADING=1", "STATUS=restarting child processes")
+			reloadMu.Lock()
+			conf := currentConf.Load()
 			// 設定ファイルを再読み込み
-			newConf, err := config.Load(conf.Path)
+			newConf, err := loadReloadConfig(conf, config.Load)
 			if err != nil {
-				log.Printf("failed to load config: %v path=%s", err, conf.Path)
-			} else {
-				// ログファイルを引き継ぐ
-				if conf.LogFd != nil {
-					newConf.LogFd = conf.LogFd
-				}
-				conf = newConf
+				log.Printf("failed to reload config: %v path=%s", err, conf.Path)
+				// 以前の設定のままログファイルを開きなおす
+				c := *conf
+				newConf = &c
 			}
-			// ログファイルの開きなおし
-			if err := openLogFile(); err != nil {
+			// ログファイルを引き継ぎ、開きなおしてから設定を差し替える
+			newConf.LogFd = conf.LogFd
+			if err := openLogFile(newConf); err != nil {
 				log.Printf("failed to open log file: %v", err)
 			}
-			// 子プロセスのReadyをfalseにする
-			oldChildren := childrenSnapshot()
-			setChildrenReady(false)
-			newChild := execChildProcess(conf.LogFd, msockfd)
-			// Ready trueの子プロセスを待つ
-			ticker := time.NewTicker(1 * time.Second)
-			timer := time.NewTimer(childReadyTimeout)
-			ready := false
-		waitReady:
-			for {
-				select {
-				case <-ticker.C:
-					if hasReadyChild() {
-						ready = true
-					}
-				case <-timer.C:
-					log.Printf("timed out waiting for child process readiness")
-					break waitReady
-				}
-				if ready {
-					break
-				}
-			}
-			ticker.Stop()
-			if !timer.Stop() {
-				select {
-				case <-timer.C:
-				default:
-				}
-			}
-			if !ready {
-				restoreChildrenReady(oldChildren)
-				if err := newChild.Signal(syscall.SIGTERM); err != nil {
-					log.Printf("failed to send signal to new child process: %v", err)
-				}
+			currentConf.Store(newConf)
+			reloadMu.Unlock()
+			// 子プロセスを1つずつ入れ替える
+			reloading.Store(true)
+			err = rollChildren()
+			reloading.Store(false)
+			if err != nil {
+				log.Printf("reload rejected: %v", err)
+				notifySystemd("READY=1", "STATUS=reload failed; previous child processes are still running")
 				continue
 			}
-			// Ready falseの子プロセスを終了
-			for _, c := range childrenSnapshot() {
-				if !c.Ready {
-					// 子プロセスにSIGTERMを送る
-					if err := c.Process.Signal(syscall.SIGTERM); err != nil {
-						log.Printf("failed to send signal to child process: %v", err)
-					}
-				}
-			}
+			log.Printf("child processes restarted workers=%d", newConf.Workers)
+			notifySystemd("READY=1", fmt.Sprintf("STATUS=%d child processes ready", newConf.Workers))
 		case syscall.SIGTERM:
-			// 子プロセスを終了
-			for _, c := range childrenSnapshot() {
-				// 子プロセスにSIGTERMを送る
-				if err := c.Process.Signal(syscall.SIGTERM); err != nil {
-					log.Printf("failed to send signal to child process: %v", err)
-				}
+			notifySystemd("STOPPING=1", "STATUS=stopping")
+			shutdown(0)
+		}
+	}
+}
+
+// shutdown は子プロセスを終了させ、PIDファイルを削除して code で終了する
+func shutdown(code int) {
+	shuttingDown.Store(true)
+	conf := currentConf.Load()
+	// 子プロセスを終了
+	for _, c := range childrenSnapshot() {
+		// 子プロセスにSIGTERMを送る
+		if err := c.Process.Signal(syscall.SIGTERM); err != nil {
+			log.Printf("failed to send signal to child process: %v", err)
+		}
+	}
+	// 子プロセスが処理中のセッションを終えて終了するまで待つ
+	log.Printf("waiting for child processes to drain timeout=%s", conf.ShutdownTimeoutDuration)
+	if !waitChildren(conf.ShutdownTimeoutDuration + childExitGrace) {
+		for _, c := range childrenSnapshot() {
+			log.Printf("child process did not exit; killing pid=%d", c.Process.Pid)
+			if err := c.Process.Kill(); err != nil {
+				log.Printf("failed to kill child process: %v", err)
 			}
-			// PIDファイルを削除
-			if err := os.Remove(conf.PidFile.Path); err != nil {
-				log.Printf("failed to remove pid file: %v", err)
+		}
+		waitChildren(childExitGrace)
+	}
+	log.Printf("all child processes exited")
+	// PIDファイルを削除
+	if err := os.Remove(conf.PidFile.Path); err != nil {
+		log.Printf("failed to remove pid file: %v", err)
+	}
+	// ログファイルを閉じる
+	if conf.LogFd != nil {
+		if err := conf.LogFd.Close(); err != nil {
+			log.Printf("failed to close log file: %v", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// reloadConfig は設定ファイルを読み込み、新しいセッションで使用する設定を差し替える
+func reloadConfig(server *arcmilter.ARCMilter) error {
+	conf := currentConf.Load()
+	load := config.Load
+	if conf.Foreground {
+		load = config.LoadForeground
+	}
+	if parentKeys != nil {
+		load = loadWithParentKeys
+	}
+	newConf, err := loadReloadConfig(conf, load)
+	if err != nil {
+		return err
+	}
+	// 使用できない鍵がある場合は以前の設定のまま処理を続ける
+	if err := arcmilter.SelfCheck(newConf); err != nil {
+		return fmt.Errorf("self-check failed: %v", err)
+	}
+	newConf.LogFd = conf.LogFd
+	currentConf.Store(newConf)
+	server.SetDebug(newConf.Debug)
+	server.SetConfig(newConf)
+	return nil
+}
+
+// loadWithParentKeys は親プロセスが読み込んだ秘密鍵を使用して設定ファイルを読み込む
+// 子プロセスは権限を変更しているため、秘密鍵のファイルを読めない場合がある
+func loadWithParentKeys(path string) (*config.Config, error) {
+	var reply control.KeysReply
+	if err := parentKeys.Call("Keys.Get", struct{}{}, &reply); err != nil {
+		return nil, fmt.Errorf("failed to get keys from parent process: %v", err)
+	}
+	return config.LoadWithKeys(path, reply.Keys)
+}
+
+// waitReload は親プロセスからの指示を待ち、ドメイン設定と鍵を再読み込みする
+func waitReload(ctrl *rpc.Client, server *arcmilter.ARCMilter) {
+	generation := -1
+	for {
+		var reply control.WaitReloadReply
+		if err := ctrl.Call("Control.WaitReload", control.WaitReloadArgs{Pid: os.Getpid(), Generation: generation}, &reply); err != nil {
+			log.Printf("failed to wait reload: %v", err)
+			return
+		}
+		if generation >= 0 {
+			args := control.ChildReloadedArgs{Pid: os.Getpid(), Generation: reply.Generation}
+			if err := reloadConfig(server); err != nil {
+				log.Printf("failed to reload config pid=%d: %v", os.Getpid(), err)
+				args.Error = err.Error()
+			} else {
+				log.Printf("config reloaded pid=%d generation=%d", os.Getpid(), reply.Generation)
 			}
-			// ログファイルを閉じる
-			if conf.LogFd != nil {
-				if err := conf.LogFd.Close(); err != nil {
-					log.Printf("failed to close log file: %v", err)
-				}
+			if err := ctrl.Call("Control.ChildReloaded", args, &struct{}{}); err != nil {
+				log.Printf("failed to notify child reloaded: %v", err)
 			}
-			os.Exit(0)
 		}
+		generation = reply.Generation
+	}
+}
+
+// loadReloadConfig は再読み込みする設定を load で読み込む
+// 待ち受けのソケットは起動時に作成したものを使い続けるため、待ち受けを変更した設定は再起動するまで適用できない
+func loadReloadConfig(conf *config.Config, load func(string) (*config.Config, error)) (*config.Config, error) {
+	newConf, err := load(conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !sameMilterListens(conf.MilterListens, newConf.MilterListens) {
+		return nil, errors.New("MilterListens changed; restart is required to apply listen addresses")
 	}
+	return newConf, nil
 }
 
-func childProcess() {
-	socketfd := os.NewFile(uintptr(4), "socket")
-	socket, err := net.FileListener(socketfd)
+// sameMilterListens は待ち受けのアドレスが変更されていないかを返す
+func sameMilterListens(a, b []config.MilterListen) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Network != b[i].Network || a[i].Address != b[i].Address {
+			return false
+		}
+	}
+	return true
+}
+
+// listenMilter は milter の待ち受けソケットを作成し、子プロセスに渡すためのファイルを返す
+func listenMilter(listen config.MilterListen) (*os.File, error) {
+	if listen.Network == "unix" {
+		if err := os.Remove(listen.Address); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove socket: %v", err)
+		}
+		msocket, err := net.Listen("unix", listen.Address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen socket: %v", err)
+		}
+		defer msocket.Close()
+		// socketのパーミッションを変更
+		if err := os.Chmod(listen.Address, fs.FileMode(listen.Mode)); err != nil {
+			return nil, fmt.Errorf("failed to change socket permission: %v", err)
+		}
+		// socketのオーナーを変更
+		if err := os.Chown(listen.Address, listen.Uid, listen.Gid); err != nil {
+			return nil, fmt.Errorf("failed to change socket owner: %v", err)
+		}
+		// Close でソケットファイルが削除されないようにする
+		msocket.(*net.UnixListener).SetUnlinkOnClose(false)
+		return msocket.(*net.UnixListener).File()
+	}
+
+	msocket, err := net.Listen(listen.Network, listen.Address)
 	if err != nil {
-		log.Fatalf("Failed to get socket: %v", err)
+		return nil, fmt.Errorf("failed to listen socket: %v", err)
+	}
+	defer msocket.Close()
+	return msocket.(*net.TCPListener).File()
+}
+
+func childProcess(sockets int) {
+	conf := currentConf.Load()
+	// 待ち受けのソケットは fd 4 から順に MilterListens の順で渡される
+	if sockets != len(conf.MilterListens) {
+		log.Fatalf("Number of milter sockets %d does not match MilterListens %d; restart is required to change listen addresses", sockets, len(conf.MilterListens))
+	}
+	listeners := make([]net.Listener, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		socketfd := os.NewFile(uintptr(4+i), "socket")
+		socket, err := net.FileListener(socketfd)
+		if err != nil {
+			log.Fatalf("Failed to get socket: %v", err)
+		}
+		listeners = append(listeners, socket)
 	}
+	// 秘密鍵を受け取る接続は待ち受けのソケットの次の fd で渡される
+	parentKeys = rpc.NewClient(os.NewFile(uintptr(4+sockets), "keys"))
+	defer parentKeys.Close()
 
 	// control用のソケットに接続
 	ctrl, err := rpc.Dial("unix", conf.ControlSocketFile.Path)
@@ -282,6 +551,9 @@ func childProcess() {
 	// ArcMilterServerの作成
 	server := arcmilter.New(ctrl)
 	server.SetDebug(conf.Debug)
+	server.SetClock(signClock)
+	// 待ち受けの開始と再読み込みの前に設定する
+	server.SetConfig(conf)
 
 	// 子プロセスの権限を変更
 	if err := syscall.Setgid(conf.Gid); err != nil {
@@ -295,82 +567,209 @@ func childProcess() {
 		log.Printf("config: %+v", conf)
 	}
 
+	// 新しい接続の受け付けを止める
+	var closeOnce sync.Once
+	closeListeners := func() {
+		closeOnce.Do(func() {
+			// fdを閉じる
+			for _, socket := range listeners {
+				if err := socket.Close(); err != nil {
+					log.Printf("failed to close socket: %v", err)
+				}
+			}
+		})
+	}
+
 	go func() {
 		sig := make(chan os.Signal, 1)
 		signal.Notify(sig, syscall.SIGTERM)
 		for {
 			switch <-sig {
 			case syscall.SIGTERM:
-				log.Printf("received SIGTERM child process closing socket pid=%d", os.Getpid())
-				// fdを閉じる
-				if err := socket.Close(); err != nil {
-					log.Printf("failed to close socket: %v", err)
-				}
+				log.Printf("received SIGTERM child process closing socket pid=%d active sessions=%d", os.Getpid(), server.ActiveSessions())
+				closeListeners()
 			}
 		}
 	}()
 
-	// 1秒待ってから親プロセスに準備完了を通知
+	// MaxSessionsPerChild に達したら代わりの子プロセスを起動させてから受け付けを止める
+	if conf.MaxSessionsPerChild > 0 {
+		server.SetMaxSessions(int64(conf.MaxSessionsPerChild), func() {
+			log.Printf("child process reached MaxSessionsPerChild=%d closing socket pid=%d", conf.MaxSessionsPerChild, os.Getpid())
+			if err := ctrl.Call("Control.ChildRetiring", control.ChildRetiringArgs{Pid: os.Getpid()}, &struct{}{}); err != nil {
+				log.Printf("failed to notify child retiring: %v", err)
+			}
+			closeListeners()
+		})
+	}
+
+	// 親プロセスからの再読み込み指示を待つ
+	go waitReload(ctrl, server)
+
+	errCh := make(chan error, len(listeners))
+	for i, socket := range listeners {
+		go func(i int, socket net.Listener) {
+			errCh <- server.Serve(socket, conf, i)
+		}(i, socket)
+	}
+
+	// 待ち受けの開始とセルフチェックが終わってから親プロセスに準備完了を通知
+	// 準備に失敗した場合は新しい接続の受け付けを止めて終了する
+	var notReady atomic.Bool
 	go func() {
-		time.Sleep(1 * time.Second)
-		// 親プロセスに準備完了を通知
-		if err := ctrl.Call("Control.ChildReady", control.ChildReadyArgs{Pid: os.Getpid()}, &struct{}{}); err != nil {
-			log.Printf("failed to notify child ready: %v", err)
+		if !notifyReady(ctrl, server, len(listeners)) {
+			notReady.Store(true)
+			closeListeners()
 		}
 	}()
+	for range listeners {
+		if err := <-errCh; err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Fatalf("Failed to serve milter: %v", err)
+		}
+	}
+
+	// 新しい接続は受け付けず、処理中のセッションが終わるまで待つ
+	if server.Drain(currentConf.Load().ShutdownTimeoutDuration) {
+		log.Printf("child process drained pid=%d", os.Getpid())
+	}
+	if notReady.Load() {
+		log.Fatalf("child process exit without becoming ready pid=%d", os.Getpid())
+	}
+}
 
-	if err := server.Serve(socket, conf); err != nil && !errors.Is(err, net.ErrClosed) {
-		log.Fatalf("Failed to serve milter: %v", err)
+// notifyReady は全ての待ち受けが接続の受け付けを開始し、セルフチェックに成功した場合に
+// 親プロセスに準備完了を通知する
+// 失敗した場合はその理由を親プロセスに通知して false を返す
+func notifyReady(ctrl *rpc.Client, server *arcmilter.ARCMilter, listeners int) bool {
+	err := server.WaitAccepting(listeners, childReadyTimeout)
+	if err == nil {
+		err = arcmilter.SelfCheck(currentConf.Load())
+	}
+	if err != nil {
+		log.Printf("child process is not ready pid=%d: %v", os.Getpid(), err)
+		if err := ctrl.Call("Control.ChildFailed", control.ChildFailedArgs{Pid: os.Getpid(), Reason: err.Error()}, &struct{}{}); err != nil {
+			log.Printf("failed to notify child failed: %v", err)
+		}
+		return false
 	}
+	// 親プロセスに準備完了を通知
+	if err := ctrl.Call("Control.ChildReady", control.ChildReadyArgs{Pid: os.Getpid()}, &struct{}{}); err != nil {
+		log.Printf("failed to notify child ready: %v", err)
+	}
+	return true
 }
 
-func execChildProcess(logfd, msockfd *os.File) *os.Process {
+func execChildProcess(logfd *os.File, msockfds []*os.File) *os.Process {
+	// 権限を変更した子プロセスに秘密鍵を渡すための子プロセス専用の接続
+	keysfd, childKeysfd, err := keysSocketpair()
+	if err != nil {
+		log.Fatalf("Failed to create keys socket: %v", err)
+	}
+	files := append([]*os.File{logfd}, msockfds...)
 	cmd := exec.Cmd{
-		Stdin:  os.Stdin,
-		Stdout: logfd,
-		Stderr: logfd,
-		Path:   os.Args[0],
-		Args:   append(os.Args, "-child"),
-		ExtraFiles: []*os.File{
-			logfd,
-			msockfd,
-		},
-	}
-	err := cmd.Start()
+		Stdin:      os.Stdin,
+		Stdout:     logfd,
+		Stderr:     logfd,
+		Path:       os.Args[0],
+		Args:       append(os.Args, "-child", "-sockets", strconv.Itoa(len(msockfds))),
+		ExtraFiles: append(files, childKeysfd),
+	}
+	err = cmd.Start()
+	childKeysfd.Close()
 	if err != nil {
 		log.Fatalf("Failed to start child process: %v", err)
 	}
+	go control.NewKeys(func() map[string][]byte {
+		return currentConf.Load().KeyFiles()
+	}).ServeConn(keysfd)
 	// childlenに追加する
 	addChild(cmd.Process)
 	log.Printf("child process started pid=%d", cmd.Process.Pid)
 	go func() {
 		err = cmd.Wait()
-		if err != nil {
-			log.Printf("child process wait error: %v", err)
-			// 子プロセスが異常終了した場合は再起動
-			// すでに子プロセスが2以上起動している場合は再起動しない
-			if childCount() < 2 {
-				execChildProcess(logfd, msockfd)
-			}
-		}
+		c, _ := findChild(cmd.Process.Pid)
 		// childlenから消す
 		removeChild(cmd.Process)
 		log.Printf("child process exit pid=%d", cmd.Process.Pid)
+		if err == nil {
+			return
+		}
+		log.Printf("child process wait error: %v", err)
+		conf := currentConf.Load()
+		// 子プロセスが異常終了した場合は待ち時間を置いて再起動
+		// 入れ替えのために終了させた場合や Workers の数だけ起動している場合、停止処理中は再起動しない
+		if c.Stopping || len(activeChildren()) >= conf.Workers || shuttingDown.Load() {
+			return
+		}
+		backoff, giveUp := restarts.crashed(cmd.Process.Pid, err, time.Now(), conf.ChildRestart)
+		if giveUp {
+			log.Printf("CRASH LOOP: child process exited abnormally more than %d times within %s; giving up and exiting",
+				conf.ChildRestart.MaxCrashes, conf.ChildRestart.CrashWindowDuration)
+			notifySystemd("STATUS=child process crash loop; giving up")
+			shutdown(1)
+		}
+		log.Printf("restarting child process in %s", backoff)
+		time.Sleep(backoff)
+		// 待っている間に再読み込みでログファイルが開きなおされている場合があるため最新の設定を使う
+		conf = currentConf.Load()
+		if len(activeChildren()) >= conf.Workers || shuttingDown.Load() {
+			return
+		}
+		execChildProcess(conf.LogFd, msockfds)
 	}()
 	return cmd.Process
 }
 
+// keysSocketpair は秘密鍵を渡すための接続を作成し、親プロセス側と子プロセス側を返す
+func keysSocketpair() (*os.File, *os.File, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	syscall.CloseOnExec(fds[1])
+	return os.NewFile(uintptr(fds[0]), "keys"), os.NewFile(uintptr(fds[1]), "keys"), nil
+}
+
 func main() {
 	var child bool
 	var confPath string
+	var conf *config.Config
 	var err error
 	var versionFlag bool
+	var reload bool
+	var restartHistory bool
+	var foreground bool
+	var sockets int
+	var fixedTime int64
+
+	// メッセージの検証と署名
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			runVerify(os.Args[2:])
+			return
+		case "sign":
+			runSign(os.Args[2:])
+			return
+		}
+	}
 
 	flag.StringVar(&confPath, "conf", "arcmilter.yaml", "config file path")
 	flag.BoolVar(&child, "child", false, "child process")
+	flag.IntVar(&sockets, "sockets", 1, "number of milter sockets passed to child process")
 	flag.BoolVar(&versionFlag, "version", false, "show version")
+	flag.BoolVar(&reload, "reload", false, "reload domains and keys of the running process")
+	flag.BoolVar(&foreground, "foreground", false, "run in a single process without PID file or child processes")
+	flag.BoolVar(&restartHistory, "restart-history", false, "show child process restart history of the running process")
+	flag.Int64Var(&fixedTime, "fixed-time", 0, "use the given UNIX time as the signing time (for testing)")
 	flag.Parse()
 
+	// 署名時刻を固定する (子プロセスには同じ引数で渡される)
+	if fixedTime > 0 {
+		signClock = func() time.Time { return time.Unix(fixedTime, 0) }
+	}
+
 	// バージョン表示
 	if versionFlag {
 		fmt.Printf("arcmilter version %s\n", version)
@@ -390,16 +789,48 @@ func main() {
 	}
 
 	// 設定ファイルを読み込む
-	conf, err = config.Load(confPath)
+	if foreground {
+		conf, err = config.LoadForeground(confPath)
+	} else {
+		conf, err = config.Load(confPath)
+	}
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	currentConf.Store(conf)
+
+	// 起動中のプロセスに再読み込みを要求する
+	if reload {
+		if err := requestReload(conf.ControlSocketFile.Path); err != nil {
+			log.Fatalf("Failed to reload: %v", err)
+		}
+		fmt.Println("reload requested")
+		return
+	}
+
+	// 起動中のプロセスから子プロセスの再起動履歴を取得する
+	if restartHistory {
+		events, err := requestRestartHistory(conf.ControlSocketFile.Path)
+		if err != nil {
+			log.Fatalf("Failed to get restart history: %v", err)
+		}
+		for _, e := range events {
+			fmt.Printf("%s pid=%d backoff=%s gaveup=%t error=%s\n", e.Time.Format(time.RFC3339), e.Pid, e.Backoff, e.GaveUp, e.Error)
+		}
+		return
+	}
 
 	// childプロセスの場合
 	if child {
 		// child process
 		conf.LogFd = os.NewFile(uintptr(3), "log")
-		childProcess()
+		childProcess(sockets)
+		return
+	}
+
+	// フォアグラウンドモードの場合
+	if foreground {
+		runForeground()
 		return
 	}
 
@@ -409,73 +840,82 @@ func main() {
 	}
 
 	// ログファイルをセットする
-	if err := openLogFile(); err != nil {
+	if err := openLogFile(conf); err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
 
-	if conf.MilterListen.Network == "unix" {
-		// milter listen
-		if err := os.Remove(conf.MilterListen.Address); err != nil && !os.IsNotExist(err) {
-			log.Fatalf("Failed to remove socket: %v", err)
-		}
-		msocket, err := net.Listen("unix", conf.MilterListen.Address)
-		if err != nil {
-			log.Fatalf("Failed to listen socket: %v", err)
-		}
-		defer msocket.Close()
-		// socketのパーミッションを変更
-		if err := os.Chmod(conf.MilterListen.Address, fs.FileMode(conf.MilterListen.Mode)); err != nil {
-			log.Fatalf("Failed to change socket permission: %v", err)
-		}
-		// socketのオーナーを変更
-		if err := os.Chown(conf.MilterListen.Address, conf.MilterListen.Uid, conf.MilterListen.Gid); err != nil {
-			log.Fatalf("Failed to change socket owner: %v", err)
-		}
-		msockfd, err = msocket.(*net.UnixListener).File()
-		if err != nil {
-			log.Fatalf("Failed to get socket fd: %v", err)
+	// systemd のソケットアクティベーションで渡されたソケットを MilterListens の順に使う
+	sdfiles, err := systemdListenFiles()
+	if err != nil {
+		log.Fatalf("Failed to get sockets from systemd: %v", err)
+	}
+	if len(sdfiles) > 0 {
+		if len(sdfiles) != len(conf.MilterListens) {
+			log.Fatalf("Number of sockets from systemd %d does not match MilterListens %d", len(sdfiles), len(conf.MilterListens))
 		}
+		msockfds = sdfiles
+		log.Printf("using %d sockets from systemd socket activation", len(sdfiles))
 	} else {
 		// milter listen
-		msocket, err := net.Listen(conf.MilterListen.Network, conf.MilterListen.Address)
-		if err != nil {
-			log.Fatalf("Failed to listen socket: %v", err)
-		}
-		defer msocket.Close()
-		msockfd, err = msocket.(*net.TCPListener).File()
-		if err != nil {
-			log.Fatalf("Failed to get socket fd: %v", err)
+		for _, listen := range conf.MilterListens {
+			msockfd, err := listenMilter(listen)
+			if err != nil {
+				log.Fatalf("Failed to listen %s:%s: %v", listen.Network, listen.Address, err)
+			}
+			msockfds = append(msockfds, msockfd)
 		}
 	}
 
 	// controlのソケットを作成
-	// scoketが存在していたら削除
-	if err := os.Remove(conf.ControlSocketFile.Path); err != nil && !os.IsNotExist(err) {
-		log.Fatalf("Failed to remove socket: %v", err)
-	}
-	csocket, err := net.Listen("unix", conf.ControlSocketFile.Path)
+	csocket, err := listenControl()
 	if err != nil {
-		log.Fatalf("Failed to listen socket: %v", err)
+		log.Fatalf("Failed to listen control socket: %v", err)
 	}
 	defer csocket.Close()
-	// socketのパーミッションを変更
-	if err := os.Chmod(conf.ControlSocketFile.Path, fs.FileMode(conf.ControlSocketFile.Mode)); err != nil {
-		log.Fatalf("Failed to change socket permission: %v", err)
-	}
 
 	// control rpcサーバーを起動
+	controller = control.New(func(pid int) {
+		log.Printf("child process ready pid=%d", pid)
+		markChildReady(pid)
+		if shuttingDown.Load() || reloading.Load() {
+			return
+		}
+		notifySystemd("READY=1", fmt.Sprintf("STATUS=child process ready pid=%d", pid), fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	})
+	controller.HandleChildFailed(func(pid int, reason string) {
+		log.Printf("child process failed pid=%d: %s", pid, reason)
+		markChildFailed(pid, reason)
+		notifySystemd(fmt.Sprintf("STATUS=child process failed pid=%d: %s", pid, reason))
+	})
+	controller.HandleChildRetiring(func(pid int) {
+		log.Printf("child process retiring pid=%d", pid)
+		markChildStopping(pid)
+		// 代わりの子プロセスを起動する
+		conf := currentConf.Load()
+		if !shuttingDown.Load() && len(activeChildren()) < conf.Workers {
+			execChildProcess(conf.LogFd, msockfds)
+		}
+	})
+	controller.HandleReload(reloadDomains)
+	controller.HandleRestartHistory(restarts.events)
+	controller.HandleChildReloaded(func(pid int, generation int, err string) {
+		if err != "" {
+			log.Printf("child process reload failed pid=%d generation=%d: %s", pid, generation, err)
+			return
+		}
+		log.Printf("child process reloaded pid=%d generation=%d", pid, generation)
+	})
 	go func() {
-		ctrl := control.New(func(pid int) {
-			log.Printf("child process ready pid=%d", pid)
-			markChildReady(pid)
-		})
-		if err := ctrl.Serve(csocket); err != nil {
+		if err := controller.Serve(csocket); err != nil {
 			log.Fatalf("Failed to serve control socket: %v", err)
 		}
 	}()
 
 	// 子プロセスの実行
-	go execChildProcess(conf.LogFd, msockfd)
+	// 子プロセスは同じ待ち受けのソケットを共有する
+	for i := 0; i < conf.Workers; i++ {
+		execChildProcess(conf.LogFd, msockfds)
+	}
 
 	checkSignal()
 }
@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -14,6 +15,8 @@ import (
 	"time"
 
 	"github.com/d--j/go-milter"
+	"github.com/masa23/arcmilter/arcmilter"
+	"github.com/masa23/arcmilter/config"
 	"github.com/masa23/mmauth/arc"
 	"github.com/masa23/mmauth/dkim"
 )
@@ -39,6 +42,12 @@ func TestMain(m *testing.M) {
 
 var testExecCmd *exec.Cmd
 
+// testSignatureTTL は t/test.yaml の SignatureTTL を秒で表したもの
+const testSignatureTTL = 7 * 24 * 60 * 60
+
+// testSignTime は -fixed-time で固定する署名時刻
+const testSignTime = 1700000000
+
 var testCreateFile = []struct {
 	path       string
 	permission os.FileMode
@@ -59,6 +68,16 @@ var testCreateFile = []struct {
 		permission: 0600,
 		stopExist:  true,
 	},
+	{
+		path:       "./t/tmp/arcmilter-submission.sock",
+		permission: 0600,
+		stopExist:  true,
+	},
+	{
+		path:       "./t/tmp/arcmilter-inbound.sock",
+		permission: 0600,
+		stopExist:  true,
+	},
 	{
 		path:       "./t/tmp/arcmilterctl.sock",
 		permission: 0600,
@@ -71,7 +90,14 @@ func TestExec(t *testing.T) {
 	t.Run("version", testVersion)
 	t.Run("exec", testExec)
 	t.Run("milter", testMilter)
+	t.Run("milter listeners", testMilterListeners)
+	t.Run("reload", testReload)
+	t.Run("milter after reload", testMilter)
+	t.Run("restart history", testRestartHistory)
+	t.Run("restart", testRestart)
+	t.Run("milter listeners after restart", testMilterListeners)
 	t.Run("stop", testStop)
+	t.Run("foreground", testForeground)
 }
 
 func testBuild(t *testing.T) {
@@ -91,7 +117,7 @@ func testVersion(t *testing.T) {
 }
 
 func testExec(t *testing.T) {
-	testExecCmd = exec.Command("./t/tmp/arcmilter", "-conf", "t/test.yaml")
+	testExecCmd = exec.Command("./t/tmp/arcmilter", "-conf", "t/test.yaml", "-fixed-time", strconv.Itoa(testSignTime))
 	if err := testExecCmd.Start(); err != nil {
 		t.Fatalf("failed to start arcmilter: %v", err)
 	}
@@ -180,6 +206,7 @@ func testMilter(t *testing.T) {
 				Selector:         "default",
 				Canonicalization: "relaxed/relaxed",
 				Headers:          "from:to",
+				Limit:            6,
 				Version:          1,
 			},
 		},
@@ -217,9 +244,117 @@ func testMilter(t *testing.T) {
 				Selector:         "default",
 				Canonicalization: "relaxed/relaxed",
 				Headers:          "from:to",
+				Identity:         "login-user@example.jp",
+				Limit:            6,
+				Version:          1,
+			},
+		},
+		{
+			// DKIMの署名だけを行うテスト
+			// Fromは署名対象ではないがMAIL FROMが署名対象である
+			name:         "DKIM sign with MAIL FROM identity",
+			connAddr:     "127.0.0.1",
+			connHostname: "localhost",
+			connFamily:   milter.FamilyInet,
+			connPort:     10025,
+			heloHostname: "localhost",
+			mailSender:   "<bounce@example.jp>",
+			rcptRcpt:     "<outside@example.com>",
+			headers: []struct {
+				field string
+				value string
+			}{
+				{
+					field: "From",
+					value: "list@example.org",
+				},
+				{
+					field: "To",
+					value: "outside@example.com",
+				},
+			},
+			body: "test\r\n",
+			expectDKIM: &dkim.Signature{
+				Algorithm:        "rsa-sha256",
+				BodyHash:         "g3zLYH4xKxcPrHOD18z9YfpQcnk/GaJedfustWU5uGs=",
+				Domain:           "example.jp",
+				Selector:         "default",
+				Canonicalization: "relaxed/relaxed",
+				Headers:          "from:to",
+				Limit:            6,
+				Version:          1,
+			},
+		},
+		{
+			// 既存の DKIM 署名がある場合のテスト
+			// ResignPolicy が same-domain のため別ドメインの署名があっても署名する
+			name:         "DKIM re-sign with upstream signature",
+			connAddr:     "127.0.0.1",
+			connHostname: "localhost",
+			connFamily:   milter.FamilyInet,
+			connPort:     10025,
+			heloHostname: "localhost",
+			mailSender:   "<test@example.jp>",
+			rcptRcpt:     "<outside@example.com>",
+			headers: []struct {
+				field string
+				value string
+			}{
+				{
+					field: "DKIM-Signature",
+					value: "v=1; a=rsa-sha256; c=relaxed/relaxed; d=upstream.example.org; s=app; h=from:to; bh=g3zLYH4xKxcPrHOD18z9YfpQcnk/GaJedfustWU5uGs=; b=dGVzdA==",
+				},
+				{
+					field: "From",
+					value: "test@example.jp",
+				},
+				{
+					field: "To",
+					value: "outside@example.com",
+				},
+			},
+			body: "test\r\n",
+			expectDKIM: &dkim.Signature{
+				Algorithm:        "rsa-sha256",
+				BodyHash:         "g3zLYH4xKxcPrHOD18z9YfpQcnk/GaJedfustWU5uGs=",
+				Domain:           "example.jp",
+				Selector:         "default",
+				Canonicalization: "relaxed/relaxed",
+				Headers:          "from:to",
+				Limit:            6,
 				Version:          1,
 			},
 		},
+		{
+			// 既存の DKIM 署名がある場合のテスト
+			// ResignPolicy が same-domain のため同じドメインの署名がある場合は署名しない
+			name:         "DKIM skip with same domain signature",
+			connAddr:     "127.0.0.1",
+			connHostname: "localhost",
+			connFamily:   milter.FamilyInet,
+			connPort:     10025,
+			heloHostname: "localhost",
+			mailSender:   "<test@example.jp>",
+			rcptRcpt:     "<outside@example.com>",
+			headers: []struct {
+				field string
+				value string
+			}{
+				{
+					field: "DKIM-Signature",
+					value: "v=1; a=rsa-sha256; c=relaxed/relaxed; d=example.jp; s=old; h=from:to; bh=g3zLYH4xKxcPrHOD18z9YfpQcnk/GaJedfustWU5uGs=; b=dGVzdA==",
+				},
+				{
+					field: "From",
+					value: "test@example.jp",
+				},
+				{
+					field: "To",
+					value: "outside@example.com",
+				},
+			},
+			body: "test\r\n",
+		},
 		{
 			// ARC署名だけを行うテスト
 			// RcptToがARC署名対象である
@@ -281,6 +416,8 @@ func testMilter(t *testing.T) {
 			if err != nil {
 				log.Fatalf("failed to create milter session: %v", err)
 			}
+			// 途中で失敗した場合もセッションを閉じ、停止時の待ち合わせに残さない
+			defer session.Close()
 			handleMilterResponse := func(act *milter.Action, err error) {
 				if err != nil {
 					t.Fatalf("failed to handle milter response: %v", err)
@@ -376,6 +513,23 @@ func testMilter(t *testing.T) {
 						if d.Version != e.Version {
 							t.Fatalf("version mismatch: %d != %d", d.Version, e.Version)
 						}
+						// i= がない場合は "@" + d= として解析される
+						identity := e.Identity
+						if identity == "" {
+							identity = "@" + e.Domain
+						}
+						if d.Identity != identity {
+							t.Fatalf("identity mismatch: %s != %s", d.Identity, identity)
+						}
+						if d.Limit != e.Limit {
+							t.Fatalf("limit mismatch: %d != %d", d.Limit, e.Limit)
+						}
+						if d.Timestamp != testSignTime {
+							t.Fatalf("timestamp mismatch: %d != %d", d.Timestamp, testSignTime)
+						}
+						if d.SignatureExpiration != testSignTime+testSignatureTTL {
+							t.Fatalf("expiration mismatch: %d != %d", d.SignatureExpiration, testSignTime+testSignatureTTL)
+						}
 					}
 					if strings.EqualFold(mAct.HeaderName, "ARC-Message-Signature") {
 						if tc.expectARCSignature == nil {
@@ -456,20 +610,191 @@ func testMilter(t *testing.T) {
 					}
 				}
 			}
-			session.Close()
 		})
 	}
 }
 
+// testMilterListeners は待ち受けごとの処理方針を確認する
+// 同じメッセージでも sign の待ち受けでは DKIM 署名のみ、verify の待ち受けでは ARC 署名のみを行う
+func testMilterListeners(t *testing.T) {
+	testCase := []struct {
+		name     string
+		address  string
+		expected []string
+	}{
+		{
+			name:     "sign",
+			address:  "./t/tmp/arcmilter-submission.sock",
+			expected: []string{"DKIM-Signature"},
+		},
+		{
+			name:     "verify",
+			address:  "./t/tmp/arcmilter-inbound.sock",
+			expected: []string{"ARC-Authentication-Results", "ARC-Message-Signature", "ARC-Seal"},
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			client := milter.NewClient("unix", tc.address)
+			macros := milter.NewMacroBag()
+			macros.Set(milter.MacroMTAFQDN, "example.jp")
+			session, err := client.Session(macros)
+			if err != nil {
+				t.Fatalf("failed to create milter session: %v", err)
+			}
+			defer session.Close()
+
+			check := func(act *milter.Action, err error) {
+				if err != nil {
+					t.Fatalf("failed to handle milter response: %v", err)
+				}
+				if act.StopProcessing() {
+					t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+				}
+			}
+			check(session.Conn("example.com", milter.FamilyInet, 10025, "192.0.2.1"))
+			check(session.Helo("example.com"))
+			check(session.Mail("<test@example.jp>", ""))
+			check(session.Rcpt("<test@example.jp>", ""))
+			check(session.DataStart())
+			check(session.HeaderField("From", "test@example.jp", nil))
+			check(session.HeaderField("To", "test@example.jp", nil))
+			check(session.HeaderEnd())
+			mActs, act, err := session.BodyReadFrom(strings.NewReader("test\r\n"))
+			if err != nil {
+				t.Fatalf("failed to read body: %v", err)
+			}
+			if act.StopProcessing() {
+				t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+			}
+
+			var inserted []string
+			for _, mAct := range mActs {
+				if mAct.Type == milter.ActionInsertHeader {
+					inserted = append(inserted, mAct.HeaderName)
+				}
+			}
+			sort.Strings(inserted)
+			if strings.Join(inserted, ",") != strings.Join(tc.expected, ",") {
+				t.Fatalf("inserted headers mismatch: %v != %v", inserted, tc.expected)
+			}
+		})
+	}
+}
+
+func testReload(t *testing.T) {
+	cmd := exec.Command("./t/tmp/arcmilter", "-conf", "t/test.yaml", "-reload")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("failed to reload: %v: %s", err, out)
+	}
+
+	// 子プロセスの再読み込み完了を待つ
+	for i := 0; i < 20; i++ {
+		buf, err := os.ReadFile("./t/tmp/arcmilter.log")
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		if strings.Contains(string(buf), "child process reload failed") {
+			t.Fatalf("child process reload failed")
+		}
+		if strings.Contains(string(buf), "child process reloaded pid=") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("child process was not reloaded")
+}
+
+// testRestart は SIGHUP で子プロセスが1つずつ入れ替わることを確認する
+func testRestart(t *testing.T) {
+	if err := testExecCmd.Process.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("failed to send SIGHUP: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		buf, err := os.ReadFile("./t/tmp/arcmilter.log")
+		if err != nil {
+			t.Fatalf("failed to read log file: %v", err)
+		}
+		if strings.Contains(string(buf), "reload rejected") {
+			t.Fatalf("reload rejected")
+		}
+		if strings.Contains(string(buf), "child processes restarted workers=2") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("child processes were not restarted")
+}
+
+func testRestartHistory(t *testing.T) {
+	cmd := exec.Command("./t/tmp/arcmilter", "-conf", "t/test.yaml", "-restart-history")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to get restart history: %v: %s", err, out)
+	}
+	// 子プロセスは異常終了していない
+	if len(out) != 0 {
+		t.Fatalf("unexpected restart history: %s", out)
+	}
+}
+
 func testStop(t *testing.T) {
 	defer func() {
 		// テスト終了時に強制終了
 		testExecCmd.Process.Signal(syscall.SIGKILL)
 	}()
 	if testExecCmd.Process != nil {
+		// 停止前に開始したセッションは停止要求後も最後まで処理される
+		client := milter.NewClient("unix", "./t/tmp/arcmilter-submission.sock")
+		macros := milter.NewMacroBag()
+		macros.Set(milter.MacroMTAFQDN, "example.jp")
+		session, err := client.Session(macros)
+		if err != nil {
+			t.Fatalf("failed to create milter session: %v", err)
+		}
+		defer session.Close()
+		check := func(act *milter.Action, err error) {
+			if err != nil {
+				t.Fatalf("failed to handle milter response: %v", err)
+			}
+			if act.StopProcessing() {
+				t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+			}
+		}
+		check(session.Conn("localhost", milter.FamilyInet, 10025, "127.0.0.1"))
+		check(session.Helo("localhost"))
+		check(session.Mail("<test@example.jp>", ""))
+		check(session.Rcpt("<outside@example.com>", ""))
+		check(session.DataStart())
+		check(session.HeaderField("From", "test@example.jp", nil))
+		check(session.HeaderField("To", "outside@example.com", nil))
+
 		if err := testExecCmd.Process.Signal(syscall.SIGTERM); err != nil {
 			t.Fatalf("failed to kill arcmilter: %v", err)
 		}
+		// 子プロセスが待ち受けを閉じるまで待つ
+		time.Sleep(300 * time.Millisecond)
+
+		check(session.HeaderEnd())
+		mActs, act, err := session.BodyReadFrom(strings.NewReader("test\r\n"))
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		if act.StopProcessing() {
+			t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+		}
+		signed := false
+		for _, mAct := range mActs {
+			if mAct.Type == milter.ActionInsertHeader && mAct.HeaderName == "DKIM-Signature" {
+				signed = true
+			}
+		}
+		if !signed {
+			t.Fatalf("DKIM-Signature was not inserted while draining")
+		}
+		session.Close()
+
 		if err := testExecCmd.Wait(); err != nil {
 			t.Fatalf("failed to wait arcmilter: %v", err)
 		}
@@ -488,6 +813,87 @@ func testStop(t *testing.T) {
 			}
 		}
 	}
+
+	buf, err := os.ReadFile("./t/tmp/arcmilter.log")
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	for _, expected := range []string{"child process drained pid=", "all child processes exited"} {
+		if !strings.Contains(string(buf), expected) {
+			t.Errorf("log does not contain %q", expected)
+		}
+	}
+}
+
+// testForeground は PIDファイルと control ソケットなしで1つのプロセスとして動作することを確認する
+func testForeground(t *testing.T) {
+	var stdout strings.Builder
+	cmd := exec.Command("./t/tmp/arcmilter", "-conf", "t/test-foreground.yaml", "-foreground")
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start arcmilter: %v", err)
+	}
+	defer cmd.Process.Signal(syscall.SIGKILL)
+	// 起動待ち
+	time.Sleep(500 * time.Millisecond)
+
+	client := milter.NewClient("unix", "./t/tmp/arcmilter-foreground.sock")
+	macros := milter.NewMacroBag()
+	macros.Set(milter.MacroMTAFQDN, "example.jp")
+	session, err := client.Session(macros)
+	if err != nil {
+		t.Fatalf("failed to create milter session: %v", err)
+	}
+	defer session.Close()
+	check := func(act *milter.Action, err error) {
+		if err != nil {
+			t.Fatalf("failed to handle milter response: %v", err)
+		}
+		if act.StopProcessing() {
+			t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+		}
+	}
+	check(session.Conn("localhost", milter.FamilyInet, 10025, "127.0.0.1"))
+	check(session.Helo("localhost"))
+	check(session.Mail("<test@example.jp>", ""))
+	check(session.Rcpt("<outside@example.com>", ""))
+	check(session.DataStart())
+	check(session.HeaderField("From", "test@example.jp", nil))
+	check(session.HeaderField("To", "outside@example.com", nil))
+
+	// 停止要求後も処理中のセッションは最後まで処理される
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to send SIGTERM: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	check(session.HeaderEnd())
+	mActs, act, err := session.BodyReadFrom(strings.NewReader("test\r\n"))
+	if err != nil {
+		t.Fatalf("failed to read body: %v", err)
+	}
+	if act.StopProcessing() {
+		t.Fatalf("unexpected stop processing: %s", act.SMTPReply)
+	}
+	signed := false
+	for _, mAct := range mActs {
+		if mAct.Type == milter.ActionInsertHeader && mAct.HeaderName == "DKIM-Signature" {
+			signed = true
+		}
+	}
+	if !signed {
+		t.Fatalf("DKIM-Signature was not inserted")
+	}
+	session.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("failed to wait arcmilter: %v", err)
+	}
+	for _, expected := range []string{"ready pid=", "drained pid="} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("stdout does not contain %q: %s", expected, stdout.String())
+		}
+	}
 }
 
 func Test_checkPidFile(t *testing.T) {
@@ -579,3 +985,105 @@ func Test_checkPidFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_loadReloadConfig(t *testing.T) {
+	orig, err := os.ReadFile("./t/test.yaml")
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	conf, err := config.Load("./t/test.yaml")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		old       string
+		new       string
+		expectErr bool
+	}{
+		{
+			name:      "listens unchanged",
+			old:       "Workers: 2",
+			new:       "Workers: 3",
+			expectErr: false,
+		},
+		{
+			name:      "listen address changed",
+			old:       "./t/tmp/arcmilter-inbound.sock",
+			new:       "./t/tmp/arcmilter-inbound2.sock",
+			expectErr: true,
+		},
+		{
+			name:      "listen removed",
+			old:       "  - Network: unix\n    Address: ./t/tmp/arcmilter-inbound.sock\n    Mode: 0600\n    Policy: verify\n",
+			new:       "",
+			expectErr: true,
+		},
+		{
+			name:      "invalid config",
+			old:       "Workers: 2",
+			new:       "Workers: -1",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if !strings.Contains(string(orig), tc.old) {
+				t.Fatalf("config does not contain %q", tc.old)
+			}
+			path := "./t/tmp/reload.yaml"
+			if err := os.WriteFile(path, []byte(strings.Replace(string(orig), tc.old, tc.new, 1)), 0600); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+			defer os.Remove(path)
+
+			c := *conf
+			c.Path = path
+			newConf, err := loadReloadConfig(&c, config.Load)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if newConf.Workers != 3 {
+				t.Errorf("expected Workers 3, got %d", newConf.Workers)
+			}
+		})
+	}
+}
+
+func Test_reloadConfig(t *testing.T) {
+	orig, err := os.ReadFile("./t/test.yaml")
+	if err != nil {
+		t.Fatalf("failed to read config: %v", err)
+	}
+	conf, err := config.Load("./t/test.yaml")
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	// 待ち受けのアドレスを変更した設定は子プロセスでも適用しない
+	path := "./t/tmp/reload.yaml"
+	changed := strings.Replace(string(orig), "./t/tmp/arcmilter-inbound.sock", "./t/tmp/arcmilter-inbound2.sock", 1)
+	if err := os.WriteFile(path, []byte(changed), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	defer os.Remove(path)
+
+	c := *conf
+	c.Path = path
+	currentConf.Store(&c)
+	defer currentConf.Store(nil)
+	if err := reloadConfig(arcmilter.New(nil)); err == nil {
+		t.Fatalf("expected error, got nil")
+	}
+	if currentConf.Load() != &c {
+		t.Errorf("config was replaced")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/control"
+)
+
+// restartHistoryLimit は保持する再起動履歴の件数
+const restartHistoryLimit = 100
+
+// restartTracker は子プロセスの異常終了を記録し、再起動までの待ち時間と再起動を諦めるかを決める
+type restartTracker struct {
+	mu      sync.Mutex
+	crashes []time.Time
+	history []control.RestartEvent
+}
+
+// crashed は子プロセスの異常終了を記録し、再起動までの待ち時間を返す
+// CrashWindow の間の異常終了が MaxCrashes 回を超えた場合は giveUp に true を返す
+func (r *restartTracker) crashed(pid int, err error, at time.Time, conf config.ChildRestart) (backoff time.Duration, giveUp bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// CrashWindow より前の異常終了は数えない
+	crashes := r.crashes[:0]
+	for _, t := range r.crashes {
+		if at.Sub(t) < conf.CrashWindowDuration {
+			crashes = append(crashes, t)
+		}
+	}
+	r.crashes = append(crashes, at)
+
+	giveUp = len(r.crashes) > conf.MaxCrashes
+	if !giveUp {
+		// 異常終了が続くたびに待ち時間を倍にする
+		backoff = conf.InitialBackoffDuration
+		for i := 1; i < len(r.crashes) && backoff < conf.MaxBackoffDuration; i++ {
+			backoff *= 2
+		}
+		if backoff > conf.MaxBackoffDuration {
+			backoff = conf.MaxBackoffDuration
+		}
+	}
+
+	r.history = append(r.history, control.RestartEvent{
+		Time:    at,
+		Pid:     pid,
+		Error:   err.Error(),
+		Backoff: backoff,
+		GaveUp:  giveUp,
+	})
+	if len(r.history) > restartHistoryLimit {
+		r.history = r.history[len(r.history)-restartHistoryLimit:]
+	}
+	return backoff, giveUp
+}
+
+// events は再起動履歴を古い順に返す
+func (r *restartTracker) events() []control.RestartEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := make([]control.RestartEvent, len(r.history))
+	copy(events, r.history)
+	return events
+}
+
+// requestRestartHistory は起動中の親プロセスから control ソケット経由で再起動履歴を取得する
+func requestRestartHistory(path string) ([]control.RestartEvent, error) {
+	ctrl, err := rpc.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect control socket: %v", err)
+	}
+	defer ctrl.Close()
+	var reply control.RestartHistoryReply
+	if err := ctrl.Call("Control.RestartHistory", struct{}{}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Events, nil
+}
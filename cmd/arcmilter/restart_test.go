@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+func Test_restartTracker(t *testing.T) {
+	conf := config.ChildRestart{
+		MaxCrashes:             3,
+		InitialBackoffDuration: 1 * time.Second,
+		MaxBackoffDuration:     3 * time.Second,
+		CrashWindowDuration:    1 * time.Minute,
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name            string
+		at              time.Duration
+		expectedBackoff time.Duration
+		expectedGiveUp  bool
+	}{
+		{
+			name:            "first crash",
+			at:              0,
+			expectedBackoff: 1 * time.Second,
+		},
+		{
+			name:            "second crash doubles backoff",
+			at:              10 * time.Second,
+			expectedBackoff: 2 * time.Second,
+		},
+		{
+			name:            "backoff is capped",
+			at:              20 * time.Second,
+			expectedBackoff: 3 * time.Second,
+		},
+		{
+			name:            "crash after the window resets the count",
+			at:              90 * time.Second,
+			expectedBackoff: 1 * time.Second,
+		},
+		{
+			name:            "second crash in the new window",
+			at:              100 * time.Second,
+			expectedBackoff: 2 * time.Second,
+		},
+		{
+			name:            "third crash in the new window",
+			at:              110 * time.Second,
+			expectedBackoff: 3 * time.Second,
+		},
+		{
+			name:           "crash loop",
+			at:             120 * time.Second,
+			expectedGiveUp: true,
+		},
+	}
+
+	var r restartTracker
+	for i, tc := range testCases {
+		backoff, giveUp := r.crashed(100+i, errors.New("exit status 1"), start.Add(tc.at), conf)
+		if backoff != tc.expectedBackoff || giveUp != tc.expectedGiveUp {
+			t.Errorf("%s: expected backoff=%s giveUp=%t, got backoff=%s giveUp=%t",
+				tc.name, tc.expectedBackoff, tc.expectedGiveUp, backoff, giveUp)
+		}
+	}
+
+	events := r.events()
+	if len(events) != len(testCases) {
+		t.Fatalf("expected %d events, got %d", len(testCases), len(events))
+	}
+	last := events[len(events)-1]
+	if last.Pid != 100+len(testCases)-1 || !last.GaveUp || last.Error != "exit status 1" {
+		t.Errorf("unexpected last event: %+v", last)
+	}
+}
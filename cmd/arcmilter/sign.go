@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/signer"
+)
+
+// stringList は複数回指定できるフラグの値
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// runSign はメッセージに milter と同じ処理で DKIM と ARC の署名を行い標準出力に出力する
+// メッセージは引数のファイルもしくは標準入力から読み込む
+func runSign(args []string) {
+	fs := flag.NewFlagSet("sign", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s sign [options] [message.eml]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	var rcpts stringList
+	confPath := fs.String("conf", "arcmilter.yaml", "config file path")
+	fromIP := fs.String("from-ip", "", "client IP address of the SMTP session")
+	fromHost := fs.String("from-host", "", "client hostname of the SMTP session used for InternalHosts and TrustedNetworks")
+	helo := fs.String("helo", "", "HELO name of the SMTP session")
+	mailFrom := fs.String("mail-from", "", "MAIL FROM address of the SMTP session")
+	fs.Var(&rcpts, "rcpt", "RCPT TO address of the SMTP session (can be repeated)")
+	authUser := fs.String("auth", "", "SMTP AUTH user name of the SMTP session")
+	listen := fs.Int("listen", 0, "index of MilterListens whose Policy and SigningIdentities are used")
+	fs.Parse(args)
+
+	log.SetFlags(0)
+	env := signer.Envelope{
+		Helo:     *helo,
+		MailFrom: *mailFrom,
+		Rcpts:    rcpts,
+		AuthUser: *authUser,
+		Hostname: *fromHost,
+	}
+	if *fromIP != "" {
+		if env.RemoteAddr = net.ParseIP(*fromIP); env.RemoteAddr == nil {
+			log.Fatalf("invalid -from-ip %q", *fromIP)
+		}
+	}
+
+	conf, err := config.Load(*confPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if *listen < 0 || *listen >= len(conf.MilterListens) {
+		log.Fatalf("MilterListens[%d] is not configured", *listen)
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to open message: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	added, err := signer.SignMessage(r, os.Stdout, conf, &conf.MilterListens[*listen], env)
+	if err != nil {
+		log.Fatalf("Failed to sign message: %v", err)
+	}
+	if added == 0 {
+		log.Printf("no signature added")
+	}
+}
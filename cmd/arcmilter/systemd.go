@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// sdListenFdsStart は systemd のソケットアクティベーションで渡される最初の fd
+const sdListenFdsStart = 3
+
+// parseListenFds は LISTEN_PID と LISTEN_FDS から systemd に渡されたソケットの数を返す
+// 自プロセス宛てでない場合は 0 を返す
+func parseListenFds(listenPid, listenFds string, pid int) (int, error) {
+	if listenPid == "" || listenFds == "" {
+		return 0, nil
+	}
+	p, err := strconv.Atoi(listenPid)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LISTEN_PID %q", listenPid)
+	}
+	if p != pid {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(listenFds)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid LISTEN_FDS %q", listenFds)
+	}
+	return n, nil
+}
+
+// systemdListenFiles は systemd のソケットアクティベーションで渡されたソケットを返す
+// 子プロセスが誤って使用しないよう環境変数は削除する
+func systemdListenFiles() ([]*os.File, error) {
+	n, err := parseListenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getpid())
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, n)
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		files = append(files, os.NewFile(uintptr(fd), "systemd-socket-"+strconv.Itoa(fd)))
+	}
+	return files, nil
+}
+
+// sdNotify は NOTIFY_SOCKET に状態を通知する
+// systemd から起動されていない場合は何もしない
+func sdNotify(state ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// 抽象名前空間のソケット
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect notify socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(strings.Join(state, "\n"))); err != nil {
+		return fmt.Errorf("failed to notify: %v", err)
+	}
+	return nil
+}
+
+// notifySystemd は sdNotify を呼び出し、失敗した場合はログに出力する
+func notifySystemd(state ...string) {
+	if err := sdNotify(state...); err != nil {
+		log.Printf("failed to notify systemd: %v", err)
+	}
+}
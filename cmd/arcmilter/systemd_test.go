@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseListenFds(t *testing.T) {
+	testCases := []struct {
+		name      string
+		listenPid string
+		listenFds string
+		expected  int
+		expectErr bool
+	}{
+		{
+			name:     "not set",
+			expected: 0,
+		},
+		{
+			name:      "own process",
+			listenPid: "100",
+			listenFds: "2",
+			expected:  2,
+		},
+		{
+			name:      "other process",
+			listenPid: "200",
+			listenFds: "2",
+			expected:  0,
+		},
+		{
+			name:      "invalid LISTEN_PID",
+			listenPid: "abc",
+			listenFds: "1",
+			expectErr: true,
+		},
+		{
+			name:      "invalid LISTEN_FDS",
+			listenPid: "100",
+			listenFds: "-1",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := parseListenFds(tc.listenPid, tc.listenFds, 100)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, n)
+			}
+		})
+	}
+}
+
+func Test_sdNotify(t *testing.T) {
+	// NOTIFY_SOCKET がない場合は何もしない
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("READY=1", "STATUS=ready"); err != nil {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got := string(buf[:n]); got != "READY=1\nSTATUS=ready" {
+		t.Errorf("unexpected message: %q", got)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/signer"
+	"github.com/masa23/mmauth/domainkey"
+)
+
+// runVerify はメッセージの DKIM と ARC の署名を milter と同じ処理で検証して結果を出力する
+// メッセージは引数のファイルもしくは標準入力から読み込む
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [options] [message.eml]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	zonePath := fs.String("zone", "", "zone file used instead of DNS")
+	ip := fs.String("ip", "", "client IP address used for SPF")
+	helo := fs.String("helo", "", "HELO name used for SPF")
+	mailFrom := fs.String("mail-from", "", "MAIL FROM address used for SPF")
+	authservID := fs.String("authserv-id", "", "authserv-id of Authentication-Results (default hostname)")
+	policy := fs.String("partial-body-policy", config.PartialBodyPolicyAccept, "handling of DKIM signatures whose l= covers part of the body (accept, flag, downgrade)")
+	fs.Parse(args)
+
+	log.SetFlags(0)
+	switch *policy {
+	case config.PartialBodyPolicyAccept, config.PartialBodyPolicyFlag, config.PartialBodyPolicyDowngrade:
+	default:
+		log.Fatalf("invalid -partial-body-policy %q", *policy)
+	}
+
+	opts := signer.VerifyOptions{
+		Envelope: signer.Envelope{
+			Helo:     *helo,
+			MailFrom: *mailFrom,
+		},
+		PartialBodyPolicy: *policy,
+	}
+	if *ip != "" {
+		if opts.Envelope.RemoteAddr = net.ParseIP(*ip); opts.Envelope.RemoteAddr == nil {
+			log.Fatalf("invalid -ip %q", *ip)
+		}
+	}
+	if *authservID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("Failed to get hostname: %v", err)
+		}
+		*authservID = hostname
+	}
+
+	var z *zone
+	if *zonePath != "" {
+		var err error
+		if z, err = loadZone(*zonePath); err != nil {
+			log.Fatalf("Failed to load zone file: %v", err)
+		}
+		opts.Resolver = z
+		z.useForSPF()
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to open message: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	report, err := signer.VerifyMessage(r, opts)
+	if err != nil {
+		log.Fatalf("Failed to verify message: %v", err)
+	}
+	printVerifyReport(os.Stdout, report, *authservID, z)
+}
+
+// printVerifyReport は検証結果を署名ごとに出力し、最後に Authentication-Results を出力する
+// z が指定されている場合はゾーンファイルに公開鍵がない署名にその旨を出力する
+func printVerifyReport(w io.Writer, report *signer.VerifyReport, authservID string, z *zone) {
+	if len(report.DKIM) == 0 {
+		fmt.Fprintln(w, "DKIM-Signature: none")
+	}
+	for i, sig := range report.DKIM {
+		fmt.Fprintf(w, "DKIM-Signature #%d: d=%s s=%s", i+1, sig.Domain, sig.Selector)
+		if sig.Identity != "" {
+			fmt.Fprintf(w, " i=%s", sig.Identity)
+		}
+		if sig.Limit > 0 {
+			fmt.Fprintf(w, " l=%d", sig.Limit)
+		}
+		fmt.Fprintf(w, " a=%s c=%s h=%s\n", sig.Algorithm, sig.Canonicalization, sig.Headers)
+		if sig.VerifyResult == nil {
+			fmt.Fprintln(w, "  result: none")
+		} else {
+			fmt.Fprintf(w, "  result: %s (%s)\n", sig.VerifyResult.Status(), sig.VerifyResult.Message())
+		}
+		printZoneKey(w, z, sig.Selector, sig.Domain)
+	}
+
+	if len(report.ARC) == 0 {
+		fmt.Fprintln(w, "ARC: none")
+	}
+	for _, sig := range report.ARC {
+		fmt.Fprintf(w, "ARC i=%d:\n", sig.GetInstanceNumber())
+		seal := sig.GetARCSeal()
+		if seal == nil {
+			fmt.Fprintln(w, "  ARC-Seal: missing")
+		} else {
+			fmt.Fprintf(w, "  ARC-Seal: d=%s s=%s a=%s cv=%s\n", seal.Domain, seal.Selector, seal.Algorithm, seal.ChainValidation)
+		}
+		if ams := sig.GetARCMessageSignature(); ams == nil {
+			fmt.Fprintln(w, "  ARC-Message-Signature: missing")
+		} else {
+			fmt.Fprintf(w, "  ARC-Message-Signature: d=%s s=%s a=%s c=%s h=%s\n", ams.Domain, ams.Selector, ams.Algorithm, ams.Canonicalization, ams.Headers)
+		}
+		if aar := sig.GetARCAuthenticationResults(); aar == nil {
+			fmt.Fprintln(w, "  ARC-Authentication-Results: missing")
+		} else {
+			fmt.Fprintf(w, "  ARC-Authentication-Results: %s; %s\n", aar.AuthServId, strings.Join(aar.Results, "; "))
+		}
+		if result := sig.GetVerifyResult(); result == nil {
+			fmt.Fprintln(w, "  result: none")
+		} else {
+			fmt.Fprintf(w, "  result: %s (%s)\n", result.Status(), result.Message())
+		}
+		if seal != nil {
+			printZoneKey(w, z, seal.Selector, seal.Domain)
+		}
+	}
+	if len(report.ARC) > 0 {
+		fmt.Fprintf(w, "ARC chain: %s\n", report.ARCChain)
+	}
+
+	fmt.Fprintf(w, "Authentication-Results: %s", authservID)
+	for _, result := range report.Results {
+		fmt.Fprintf(w, ";\n        %s", result)
+	}
+	fmt.Fprintln(w)
+}
+
+// printZoneKey はゾーンファイルに selector と domain の公開鍵がない場合にその旨を出力する
+func printZoneKey(w io.Writer, z *zone, selector, domain string) {
+	if z == nil {
+		return
+	}
+	if _, err := domainkey.LookupDKIMDomainKeyWithResolver(selector, domain, z); err != nil {
+		fmt.Fprintf(w, "  key: %s._domainkey.%s: %v in zone file\n", selector, domain, err)
+	}
+}
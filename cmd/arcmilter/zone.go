@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/masa23/mmauth/spf"
+)
+
+// zone はゾーンファイルから読み込んだ TXT、A、AAAA、MX レコード
+// verify サブコマンドで DNS の代わりに使用する
+type zone struct {
+	txt map[string][]string
+	ip  map[string][]net.IP
+	mx  map[string][]*net.MX
+}
+
+// zoneToken はゾーンファイルの1つの字句
+type zoneToken struct {
+	value  string
+	quoted bool
+}
+
+// zoneRecord はゾーンファイルの1つのレコード
+// indented は行頭が空白で始まり、名前を省略していることを示す
+type zoneRecord struct {
+	line     int
+	indented bool
+	tokens   []zoneToken
+}
+
+// loadZone はゾーンファイルを読み込む
+func loadZone(path string) (*zone, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read zone file: %v", err)
+	}
+	z, err := parseZone(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return z, nil
+}
+
+// parseZone はゾーンファイルを解析する
+// $ORIGIN、@、相対名、括弧による複数行のレコード、引用符で囲まれた文字列と ; のコメントに対応する
+// TXT、A、AAAA、MX 以外のレコードは読み飛ばす
+func parseZone(data string) (*zone, error) {
+	records, err := tokenizeZone(data)
+	if err != nil {
+		return nil, err
+	}
+	z := &zone{
+		txt: make(map[string][]string),
+		ip:  make(map[string][]net.IP),
+		mx:  make(map[string][]*net.MX),
+	}
+	origin := ""
+	name := ""
+	for _, r := range records {
+		tokens := r.tokens
+		if !tokens[0].quoted && strings.HasPrefix(tokens[0].value, "$") {
+			switch strings.ToUpper(tokens[0].value) {
+			case "$ORIGIN":
+				if len(tokens) != 2 {
+					return nil, fmt.Errorf("line %d: invalid $ORIGIN", r.line)
+				}
+				origin = zoneName(tokens[1].value, origin)
+			case "$TTL":
+			default:
+				return nil, fmt.Errorf("line %d: unsupported directive %s", r.line, tokens[0].value)
+			}
+			continue
+		}
+
+		if !r.indented {
+			name = zoneName(tokens[0].value, origin)
+			tokens = tokens[1:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("line %d: record name is not set", r.line)
+		}
+
+		// TTL とクラスを読み飛ばす
+		for len(tokens) > 0 && !tokens[0].quoted {
+			if _, err := strconv.ParseUint(tokens[0].value, 10, 32); err == nil {
+				tokens = tokens[1:]
+				continue
+			}
+			if c := strings.ToUpper(tokens[0].value); c == "IN" || c == "CH" || c == "HS" {
+				tokens = tokens[1:]
+				continue
+			}
+			break
+		}
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("line %d: record type is not set", r.line)
+		}
+		rtype, rdata := strings.ToUpper(tokens[0].value), tokens[1:]
+
+		switch rtype {
+		case "TXT":
+			if len(rdata) == 0 {
+				return nil, fmt.Errorf("line %d: TXT record has no data", r.line)
+			}
+			// 複数の文字列は連結して1つのレコードとする
+			var txt strings.Builder
+			for _, t := range rdata {
+				txt.WriteString(t.value)
+			}
+			z.txt[name] = append(z.txt[name], txt.String())
+		case "A", "AAAA":
+			if len(rdata) != 1 {
+				return nil, fmt.Errorf("line %d: invalid %s record", r.line, rtype)
+			}
+			ip := net.ParseIP(rdata[0].value)
+			if ip == nil || (rtype == "A") != (ip.To4() != nil) {
+				return nil, fmt.Errorf("line %d: invalid %s address %s", r.line, rtype, rdata[0].value)
+			}
+			z.ip[name] = append(z.ip[name], ip)
+		case "MX":
+			if len(rdata) != 2 {
+				return nil, fmt.Errorf("line %d: invalid MX record", r.line)
+			}
+			pref, err := strconv.ParseUint(rdata[0].value, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid MX preference %s", r.line, rdata[0].value)
+			}
+			z.mx[name] = append(z.mx[name], &net.MX{
+				Host: zoneName(rdata[1].value, origin) + ".",
+				Pref: uint16(pref),
+			})
+		}
+	}
+	return z, nil
+}
+
+// tokenizeZone はゾーンファイルをレコードごとの字句に分割する
+func tokenizeZone(data string) ([]zoneRecord, error) {
+	var records []zoneRecord
+	var current zoneRecord
+	var token strings.Builder
+	inToken, quoted, inQuote := false, false, false
+	paren := 0
+	line, start := 1, true
+
+	flush := func() {
+		if inToken {
+			current.tokens = append(current.tokens, zoneToken{value: token.String(), quoted: quoted})
+			token.Reset()
+			inToken, quoted = false, false
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if inQuote {
+			switch c {
+			case '"':
+				inQuote = false
+			case '\\':
+				if i+1 < len(data) {
+					i++
+					token.WriteByte(data[i])
+				}
+			case '\n':
+				return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+			default:
+				token.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			flush()
+			if current.line == 0 {
+				current.line = line
+			}
+			inToken, quoted, inQuote = true, true, true
+		case ';':
+			flush()
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '(':
+			flush()
+			paren++
+		case ')':
+			flush()
+			if paren == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+			}
+			paren--
+		case ' ', '\t', '\r':
+			if start && len(current.tokens) == 0 && !inToken {
+				current.indented = true
+			}
+			flush()
+		case '\n':
+			flush()
+			line++
+			if paren > 0 {
+				continue
+			}
+			if len(current.tokens) > 0 {
+				records = append(records, current)
+			}
+			current = zoneRecord{}
+			start = true
+			continue
+		default:
+			if current.line == 0 {
+				current.line = line
+			}
+			token.WriteByte(c)
+			inToken = true
+		}
+		if c != ' ' && c != '\t' && c != '\r' {
+			start = false
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+	}
+	if paren > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", line)
+	}
+	flush()
+	if len(current.tokens) > 0 {
+		records = append(records, current)
+	}
+	return records, nil
+}
+
+// zoneName は name を末尾のドットを除いた小文字の完全な名前にする
+// ドットで終わらない名前には origin を付ける
+func zoneName(name, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin == "" {
+		return name
+	}
+	return name + "." + origin
+}
+
+// notFound はレコードが存在しない場合のエラーを返す
+func (z *zone) notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// LookupTXT は domainkey.TXTResolver を実装する
+func (z *zone) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return z.lookupTXT(name)
+}
+
+func (z *zone) lookupTXT(name string) ([]string, error) {
+	if txt, ok := z.txt[zoneName(name, "")]; ok {
+		return txt, nil
+	}
+	return nil, z.notFound(name)
+}
+
+func (z *zone) lookupIP(name string) ([]net.IP, error) {
+	if ip, ok := z.ip[zoneName(name, "")]; ok {
+		return ip, nil
+	}
+	return nil, z.notFound(name)
+}
+
+func (z *zone) lookupMX(name string) ([]*net.MX, error) {
+	if mx, ok := z.mx[zoneName(name, "")]; ok {
+		return mx, nil
+	}
+	return nil, z.notFound(name)
+}
+
+func (z *zone) lookupPTR(addr string) ([]string, error) {
+	return nil, z.notFound(addr)
+}
+
+// useForSPF は SPF の検証で DNS の代わりにゾーンファイルを参照するようにする
+func (z *zone) useForSPF() {
+	spf.DefaultTXTResolver = z.lookupTXT
+	spf.DefaultIPResolver = z.lookupIP
+	spf.DefaultMXResolver = z.lookupMX
+	spf.DefaultPTRResolver = z.lookupPTR
+}
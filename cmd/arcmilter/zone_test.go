@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func Test_parseZone(t *testing.T) {
+	data := `$ORIGIN example.jp.
+$TTL 3600
+; コメント
+@               IN  TXT  "v=spf1 ip4:192.0.2.1 -all"
+default._domainkey  TXT  ( "v=DKIM1; k=rsa; "
+                           "p=MIIB" )  ; 複数行
+                    TXT  "second; record"
+mail            300 IN  A     192.0.2.1
+                    AAAA  2001:db8::1
+@                   MX    10 mail
+other.example.com.  MX    20 mx.example.com.
+                    CNAME example.jp.
+`
+	z, err := parseZone(data)
+	if err != nil {
+		t.Fatalf("failed to parse zone: %v", err)
+	}
+
+	txt, err := z.LookupTXT(context.Background(), "default._domainkey.Example.JP.")
+	if err != nil {
+		t.Fatalf("failed to lookup TXT: %v", err)
+	}
+	if expected := []string{"v=DKIM1; k=rsa; p=MIIB", "second; record"}; !reflect.DeepEqual(txt, expected) {
+		t.Errorf("expected %q, got %q", expected, txt)
+	}
+	if txt, _ := z.lookupTXT("example.jp"); !reflect.DeepEqual(txt, []string{"v=spf1 ip4:192.0.2.1 -all"}) {
+		t.Errorf("unexpected SPF record %q", txt)
+	}
+
+	ip, err := z.lookupIP("mail.example.jp")
+	if err != nil {
+		t.Fatalf("failed to lookup IP: %v", err)
+	}
+	if expected := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}; !reflect.DeepEqual(ip, expected) {
+		t.Errorf("expected %v, got %v", expected, ip)
+	}
+
+	mx, err := z.lookupMX("example.jp")
+	if err != nil {
+		t.Fatalf("failed to lookup MX: %v", err)
+	}
+	if len(mx) != 1 || mx[0].Host != "mail.example.jp." || mx[0].Pref != 10 {
+		t.Errorf("unexpected MX %+v", mx)
+	}
+	if mx, _ := z.lookupMX("other.example.com"); len(mx) != 1 || mx[0].Host != "mx.example.com." {
+		t.Errorf("unexpected MX %+v", mx)
+	}
+
+	// 存在しない名前は NXDOMAIN として扱う
+	var dnsErr *net.DNSError
+	if _, err := z.lookupTXT("unknown.example.jp"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func Test_parseZoneError(t *testing.T) {
+	testCases := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "unterminated quoted string",
+			data: "example.jp. TXT \"v=spf1\n",
+		},
+		{
+			name: "unbalanced parentheses",
+			data: "example.jp. TXT ( \"v=spf1\"\n",
+		},
+		{
+			name: "invalid A record",
+			data: "example.jp. A 2001:db8::1\n",
+		},
+		{
+			name: "invalid MX record",
+			data: "example.jp. MX mail.example.jp.\n",
+		},
+		{
+			name: "name is not set",
+			data: "  TXT \"v=spf1\"\n",
+		},
+		{
+			name: "unsupported directive",
+			data: "$INCLUDE other.zone\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseZone(tc.data); err == nil {
+				t.Errorf("expected error")
+			}
+		})
+	}
+}
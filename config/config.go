@@ -10,8 +10,11 @@ import (
 	"net"
 	"os"
 	"os/user"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -21,6 +24,85 @@ const (
 	DefaultBodyCanonicalization   = "relaxed"
 	DefaultHashAlgorithm          = "sha256"
 	DefaultSelector               = "default"
+	DefaultShutdownTimeout        = 30 * time.Second
+	DefaultRestartInitialBackoff  = 1 * time.Second
+	DefaultRestartMaxBackoff      = 1 * time.Minute
+	DefaultRestartMaxCrashes      = 5
+	DefaultRestartCrashWindow     = 5 * time.Minute
+)
+
+// DKIM 署名ドメインの決定方法
+const (
+	// ヘッダ From のドメイン
+	SigningIdentityFrom = "from"
+	// エンベロープ MAIL FROM のドメイン
+	SigningIdentityMailFrom = "mail-from"
+	// SMTP 認証ユーザ名を AuthDomains で変換したドメイン
+	SigningIdentityAuth = "auth"
+	// 指定したヘッダ（例: "header:Sender"）のアドレスのドメイン
+	SigningIdentityHeaderPrefix = "header:"
+)
+
+// 待ち受けごとの処理方針
+const (
+	// DKIM 署名と、検証および ARC 署名の両方を行う
+	ListenPolicyBoth = "both"
+	// DKIM 署名のみを行う (submission など)
+	ListenPolicySign = "sign"
+	// 検証と ARC 署名のみを行う (受信用の smtpd など)
+	ListenPolicyVerify = "verify"
+)
+
+// 待ち受けのプロトコル
+const (
+	// MTA から milter で接続を受け付ける
+	ListenProtocolMilter = "milter"
+	// SMTP で受け付けたメッセージに署名して NextHop に中継する (content filter)
+	ListenProtocolSMTP = "smtp"
+)
+
+// DKIM 署名の i= (AUID) の生成方法
+// これ以外の値は "{local}" などを含むテンプレートとして扱う
+const (
+	// ヘッダ From のアドレス
+	AUIDFrom = "from"
+	// SMTP 認証ユーザ名 (@ を含まない場合は d= のドメインを付加)
+	AUIDAuth = "auth"
+)
+
+// AUID のテンプレートで使用できるプレースホルダ
+var auidPlaceholders = []string{"{local}", "{domain}", "{subdomain}", "{auth}"}
+
+// 既に DKIM-Signature があるメッセージに DKIM 署名を行うかの方針
+const (
+	// 常に署名する
+	ResignPolicyAlways = "always"
+	// 同じ d= と s= の署名がある場合は署名しない
+	ResignPolicySameSelector = "same-selector"
+	// 同じ d= の署名がある場合は署名しない
+	ResignPolicySameDomain = "same-domain"
+	// いずれかの署名がある場合は署名しない
+	ResignPolicyAny = "any"
+)
+
+// l= が本文の一部しか含まない DKIM 署名の検証結果の扱い
+const (
+	// 検証結果をそのまま使用する
+	PartialBodyPolicyAccept = "accept"
+	// pass のまま本文の一部のみ署名されていることをコメントで示す
+	PartialBodyPolicyFlag = "flag"
+	// pass を policy に変更する
+	PartialBodyPolicyDowngrade = "downgrade"
+)
+
+// Domains のキーに使用できる特殊なドメインパターンの接頭辞
+const (
+	// カンマ区切りのドメインパターンの一覧
+	domainListPrefix = "list:"
+	// ドメインパターンを1行ずつ記述したファイル
+	domainFilePrefix = "file:"
+	// ドメインにマッチさせる正規表現 (Go の regexp の構文)
+	domainRegexpPrefix = "regex:"
 )
 
 type ConfigError struct {
@@ -38,15 +120,9 @@ type Config struct {
 	PidFile struct {
 		Path string `yaml:"Path"`
 	} `yaml:"PIDFile"`
-	MilterListen struct {
-		Network string `yaml:"Network"`
-		Address string `yaml:"Address"`
-		Mode    uint32 `yaml:"Mode"`
-		Owner   string `yaml:"Owner"`
-		Group   string `yaml:"Group"`
-		Uid     int
-		Gid     int
-	} `yaml:"MilterListen"`
+	MilterListen MilterListen `yaml:"MilterListen"`
+	// 追加の待ち受け (検証後は MilterListen を先頭に含む全ての待ち受け)
+	MilterListens     []MilterListen `yaml:"MilterListens"`
 	ControlSocketFile struct {
 		Path string `yaml:"Path"`
 		Mode uint32 `yaml:"Mode"`
@@ -56,7 +132,7 @@ type Config struct {
 		Mode uint32 `yaml:"Mode"`
 	} `yaml:"LogFile"`
 	MyNetworks       []string `yaml:"MyNetworks"`
-	ParsedMyNetworks []*net.IPNet
+	ParsedMyNetworks Networks
 	Domains          map[string]Domain `yaml:"Domains"`
 	User             string            `yaml:"User"`
 	Group            string            `yaml:"Group"`
@@ -65,6 +141,87 @@ type Config struct {
 	Debug            bool     `yaml:"Debug"`
 	ARCSignHeaders   []string `yaml:"ARCSignHeaders"`
 	DKIMSignHeaders  []string `yaml:"DKIMSignHeaders"`
+	OversignHeaders  []string `yaml:"OversignHeaders"`
+	// SMTP 認証ユーザ名から DKIM 署名ドメインへの対応表
+	AuthDomains map[string]string `yaml:"AuthDomains"`
+	// ARC 署名を行わず、TrustedNetworks を指定したドメインの DKIM 署名も許可する接続元 (CIDR、IP アドレスまたはホスト名)
+	InternalHosts       []string `yaml:"InternalHosts"`
+	ParsedInternalHosts Networks
+	// MyNetworks に加える CIDR を1行ずつ記述したファイル (SIGHUP と SIGUSR1 で再読み込み)
+	MyNetworksFile string `yaml:"MyNetworksFile"`
+	// OpenDKIM 形式の KeyTable と SigningTable (refile: 対応)
+	KeyTable     string `yaml:"KeyTable"`
+	SigningTable string `yaml:"SigningTable"`
+	// ドメインごとの設定ファイルを置くディレクトリ
+	DomainsDir string `yaml:"DomainsDir"`
+	// l= が本文の一部しか含まない DKIM 署名の検証結果の扱い
+	PartialBodyPolicy string `yaml:"PartialBodyPolicy"`
+	// 既に DKIM-Signature がある場合の DKIM 署名の方針 (ドメインごとに上書き可能)
+	ResignPolicy string `yaml:"ResignPolicy"`
+	// 停止や子プロセスの入れ替えの際に処理中のセッションの終了を待つ時間
+	ShutdownTimeout         string `yaml:"ShutdownTimeout"`
+	ShutdownTimeoutDuration time.Duration
+	// 子プロセスが異常終了した場合の再起動の設定
+	ChildRestart ChildRestart `yaml:"ChildRestart"`
+	// 親プロセスと子プロセスに分けずに1つのプロセスで動作する (PIDFile と ControlSocketFile は省略可能)
+	Foreground bool
+	// 起動する子プロセスの数
+	Workers int `yaml:"Workers"`
+	// 子プロセスを入れ替えるまでに受け付けるセッションの数 (0 の場合は入れ替えない)
+	MaxSessionsPerChild int `yaml:"MaxSessionsPerChild"`
+	// Domains の "regex:" で始まるパターンをコンパイルしたもの
+	domainRegexps []domainRegexp
+	// Domains のワイルドカードのパターンの索引 (未作成の場合は全てのパターンを順に比較する)
+	domainIndex *domainIndex
+	// 読み込んだ秘密鍵ファイルの内容 (PrivateKeyFile ごと)
+	keyFiles map[string][]byte
+}
+
+// ChildRestart は異常終了した子プロセスを再起動するまでの待ち時間と、再起動を諦める条件を表す
+// 待ち時間は InitialBackoff から異常終了のたびに倍になり、MaxBackoff を上限とする
+// CrashWindow の間に MaxCrashes 回を超えて異常終了した場合は再起動しない
+type ChildRestart struct {
+	InitialBackoff         string `yaml:"InitialBackoff"`
+	MaxBackoff             string `yaml:"MaxBackoff"`
+	MaxCrashes             int    `yaml:"MaxCrashes"`
+	CrashWindow            string `yaml:"CrashWindow"`
+	InitialBackoffDuration time.Duration
+	MaxBackoffDuration     time.Duration
+	CrashWindowDuration    time.Duration
+}
+
+// MilterListen は milter の待ち受けと、そこで受け付けたセッションの処理方針を表す
+type MilterListen struct {
+	Network string `yaml:"Network"`
+	Address string `yaml:"Address"`
+	Mode    uint32 `yaml:"Mode"`
+	Owner   string `yaml:"Owner"`
+	Group   string `yaml:"Group"`
+	Uid     int
+	Gid     int
+	// DKIM 署名ドメインを決定する方法の優先順位
+	SigningIdentities []string `yaml:"SigningIdentities"`
+	// 受け付けたセッションで行う処理 (both, sign, verify)
+	Policy string `yaml:"Policy"`
+	// 待ち受けのプロトコル (milter, smtp)
+	Protocol string `yaml:"Protocol"`
+	// Protocol が smtp の場合に署名したメッセージを中継する SMTP サーバーのアドレス (host:port)
+	NextHop string `yaml:"NextHop"`
+}
+
+// IsSMTP は SMTP で受け付けて NextHop に中継する待ち受けかを返す
+func (l *MilterListen) IsSMTP() bool {
+	return l.Protocol == ListenProtocolSMTP
+}
+
+// IsSign は DKIM 署名を行う待ち受けかを返す
+func (l *MilterListen) IsSign() bool {
+	return l.Policy != ListenPolicyVerify
+}
+
+// IsVerify は検証と ARC 署名を行う待ち受けかを返す
+func (l *MilterListen) IsVerify() bool {
+	return l.Policy != ListenPolicySign
 }
 
 type Domain struct {
@@ -80,6 +237,27 @@ type Domain struct {
 	Pattern                string // Original pattern from config (e.g., "*.example.com")
 	DKIM                   bool   `yaml:"DKIM"`
 	ARC                    bool   `yaml:"ARC"`
+	// DKIM 署名の d= に使用するドメイン (未指定の場合はマッチしたドメイン)
+	SigningDomain string `yaml:"SigningDomain"`
+	// 署名対象ヘッダ (未指定の場合は全体の設定を使用)
+	ARCSignHeaders  []string `yaml:"ARCSignHeaders"`
+	DKIMSignHeaders []string `yaml:"DKIMSignHeaders"`
+	// 出現回数より1回多く DKIM 署名の h= に含めるヘッダ (未指定の場合は全体の設定を使用)
+	OversignHeaders []string `yaml:"OversignHeaders"`
+	// DKIM 署名に t= (署名時刻) を含めるか (未指定の場合は含める)
+	SignatureTimestamp *bool `yaml:"SignatureTimestamp"`
+	// DKIM 署名の有効期間 (例: "7d", "36h")、指定した場合は x= を含める
+	SignatureTTL         string `yaml:"SignatureTTL"`
+	SignatureTTLDuration time.Duration
+	// DKIM 署名に l= (署名した本文の長さ) を含める
+	BodyLengthLimit bool `yaml:"BodyLengthLimit"`
+	// DKIM 署名の i= の生成方法 (from, auth またはテンプレート、未指定の場合は付与しない)
+	AUID string `yaml:"AUID"`
+	// 既に DKIM-Signature がある場合の DKIM 署名の方針 (未指定の場合は全体の設定を使用)
+	ResignPolicy string `yaml:"ResignPolicy"`
+	// このドメインの DKIM 署名を許可する接続元 (CIDR、IP アドレスまたはホスト名、未指定の場合は制限しない)
+	TrustedNetworks       []string `yaml:"TrustedNetworks"`
+	ParsedTrustedNetworks Networks
 }
 
 func getUid(userStr string) (int, error) {
@@ -135,8 +313,78 @@ func checkMilterListenNetwork(network string) error {
 	}
 }
 
+// parseDuration は time.ParseDuration の形式に加えて日数 ("7d") を解釈する
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// checkAUID は AUID の設定値を確認する
+func checkAUID(auid string) error {
+	switch auid {
+	case "", AUIDFrom, AUIDAuth:
+		return nil
+	}
+	if !strings.Contains(auid, "@") {
+		return fmt.Errorf(`invalid value "%s"`, auid)
+	}
+	rest := auid
+	for _, p := range auidPlaceholders {
+		rest = strings.ReplaceAll(rest, p, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf(`unknown placeholder in "%s"`, auid)
+	}
+	return nil
+}
+
+// checkResignPolicy は ResignPolicy の設定値を確認する
+func checkResignPolicy(policy string) error {
+	switch policy {
+	case ResignPolicyAlways, ResignPolicySameSelector, ResignPolicySameDomain, ResignPolicyAny:
+		return nil
+	default:
+		return fmt.Errorf(`invalid value "%s"`, policy)
+	}
+}
+
+func checkSigningIdentity(identity string) error {
+	switch identity {
+	case SigningIdentityFrom, SigningIdentityMailFrom, SigningIdentityAuth:
+		return nil
+	}
+	if strings.HasPrefix(identity, SigningIdentityHeaderPrefix) &&
+		strings.TrimSpace(identity[len(SigningIdentityHeaderPrefix):]) != "" {
+		return nil
+	}
+	return fmt.Errorf(`invalid value "%s"`, identity)
+}
+
 func Load(path string) (*Config, error) {
+	return load(path, false, nil)
+}
+
+// LoadForeground はフォアグラウンドモードで使用する設定ファイルを読み込む
+// PIDFile と ControlSocketFile は省略できる
+func LoadForeground(path string) (*Config, error) {
+	return load(path, true, nil)
+}
+
+// LoadWithKeys は秘密鍵を keys の内容から読み込む
+// 権限を変更した子プロセスが親プロセスの読み込んだ秘密鍵を使用するためのもので、keys にない秘密鍵はファイルから読み込む
+func LoadWithKeys(path string, keys map[string][]byte) (*Config, error) {
+	return load(path, false, keys)
+}
+
+func load(path string, foreground bool, keys map[string][]byte) (*Config, error) {
 	config := createDefaultConfig()
+	config.Foreground = foreground
 
 	buf, err := os.ReadFile(path)
 	if err != nil {
@@ -153,7 +401,7 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
-	err = loadKeys(config)
+	err = loadKeys(config, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -164,15 +412,7 @@ func Load(path string) (*Config, error) {
 
 func createDefaultConfig() *Config {
 	return &Config{
-		MilterListen: struct {
-			Network string `yaml:"Network"`
-			Address string `yaml:"Address"`
-			Mode    uint32 `yaml:"Mode"`
-			Owner   string `yaml:"Owner"`
-			Group   string `yaml:"Group"`
-			Uid     int
-			Gid     int
-		}{},
+		MilterListen: MilterListen{},
 		ControlSocketFile: struct {
 			Path string `yaml:"Path"`
 			Mode uint32 `yaml:"Mode"`
@@ -181,10 +421,9 @@ func createDefaultConfig() *Config {
 			Path string `yaml:"Path"`
 			Mode uint32 `yaml:"Mode"`
 		}{},
-		Domains:          make(map[string]Domain),
-		ParsedMyNetworks: make([]*net.IPNet, 0),
-		ARCSignHeaders:   make([]string, 0),
-		DKIMSignHeaders:  make([]string, 0),
+		Domains:         make(map[string]Domain),
+		ARCSignHeaders:  make([]string, 0),
+		DKIMSignHeaders: make([]string, 0),
 	}
 }
 
@@ -196,37 +435,154 @@ func parseYAML(buf []byte, config *Config) error {
 	return nil
 }
 
-func validateConfig(config *Config) error {
-	if err := checkMilterListenNetwork(config.MilterListen.Network); err != nil {
+// validateMilterListen は待ち受けの設定を検証し、省略された値を補う
+func validateMilterListen(field string, listen *MilterListen) error {
+	if err := checkMilterListenNetwork(listen.Network); err != nil {
 		return err
 	}
 
-	if config.MilterListen.Network == "unix" {
-		uid, err := getUid(config.MilterListen.Owner)
+	if listen.Network == "unix" {
+		uid, err := getUid(listen.Owner)
 		if err != nil {
 			return err
 		}
-		config.MilterListen.Uid = uid
-		gid, err := getGid(config.MilterListen.Group)
+		listen.Uid = uid
+		gid, err := getGid(listen.Group)
 		if err != nil {
 			return err
 		}
-		config.MilterListen.Gid = gid
+		listen.Gid = gid
+	}
+
+	if listen.Address == "" {
+		return &ConfigError{Field: field + ".Address", Message: "is not set"}
+	}
+
+	if listen.Mode == 0 {
+		listen.Mode = 0600
+	}
+
+	if len(listen.SigningIdentities) == 0 {
+		listen.SigningIdentities = []string{SigningIdentityFrom}
+	}
+	for _, identity := range listen.SigningIdentities {
+		if err := checkSigningIdentity(identity); err != nil {
+			return &ConfigError{Field: field + ".SigningIdentities", Message: err.Error()}
+		}
+	}
+
+	switch listen.Policy {
+	case "":
+		listen.Policy = ListenPolicyBoth
+	case ListenPolicyBoth, ListenPolicySign, ListenPolicyVerify:
+	default:
+		return &ConfigError{Field: field + ".Policy", Message: fmt.Sprintf(`invalid value "%s"`, listen.Policy)}
+	}
+
+	switch listen.Protocol {
+	case "":
+		listen.Protocol = ListenProtocolMilter
+	case ListenProtocolMilter, ListenProtocolSMTP:
+	default:
+		return &ConfigError{Field: field + ".Protocol", Message: fmt.Sprintf(`invalid value "%s"`, listen.Protocol)}
+	}
+	if listen.IsSMTP() {
+		if listen.NextHop == "" {
+			return &ConfigError{Field: field + ".NextHop", Message: "is not set"}
+		}
+		if _, _, err := net.SplitHostPort(listen.NextHop); err != nil {
+			return &ConfigError{Field: field + ".NextHop", Message: fmt.Sprintf(`invalid value "%s"`, listen.NextHop)}
+		}
+	} else if listen.NextHop != "" {
+		return &ConfigError{Field: field + ".NextHop", Message: "is only used with Protocol smtp"}
+	}
+	return nil
+}
+
+// validateMilterListens は MilterListen と MilterListens を検証し、MilterListens にまとめる
+// MilterListens のみを指定した場合は MilterListen を省略できる
+func validateMilterListens(config *Config) error {
+	listens := make([]MilterListen, 0, len(config.MilterListens)+1)
+	omitted := config.MilterListen.Network == "" && config.MilterListen.Address == "" && len(config.MilterListens) > 0
+	if !omitted {
+		if err := validateMilterListen("MilterListen", &config.MilterListen); err != nil {
+			return err
+		}
+		listens = append(listens, config.MilterListen)
+	}
+
+	seen := make(map[string]bool)
+	for _, listen := range listens {
+		seen[listen.Network+":"+listen.Address] = true
+	}
+	for i := range config.MilterListens {
+		field := fmt.Sprintf("MilterListens[%d]", i)
+		listen := config.MilterListens[i]
+		if err := validateMilterListen(field, &listen); err != nil {
+			return err
+		}
+		key := listen.Network + ":" + listen.Address
+		if seen[key] {
+			return &ConfigError{Field: field + ".Address", Message: fmt.Sprintf(`"%s" is already used`, listen.Address)}
+		}
+		seen[key] = true
+		listens = append(listens, listen)
+	}
+
+	if omitted {
+		// MilterListen を省略した場合は先頭の待ち受けを MilterListen とする
+		config.MilterListen = listens[0]
+	}
+	config.MilterListens = listens
+	return nil
+}
+
+// validateChildRestart は子プロセスの再起動の設定を検証し、省略された値にデフォルトを設定する
+func validateChildRestart(restart *ChildRestart) error {
+	durations := []struct {
+		field    string
+		value    string
+		duration *time.Duration
+		def      time.Duration
+	}{
+		{"InitialBackoff", restart.InitialBackoff, &restart.InitialBackoffDuration, DefaultRestartInitialBackoff},
+		{"MaxBackoff", restart.MaxBackoff, &restart.MaxBackoffDuration, DefaultRestartMaxBackoff},
+		{"CrashWindow", restart.CrashWindow, &restart.CrashWindowDuration, DefaultRestartCrashWindow},
+	}
+	for _, d := range durations {
+		*d.duration = d.def
+		if d.value == "" {
+			continue
+		}
+		duration, err := parseDuration(d.value)
+		if err != nil || duration <= 0 {
+			return &ConfigError{Field: "ChildRestart." + d.field, Message: fmt.Sprintf(`invalid value "%s"`, d.value)}
+		}
+		*d.duration = duration
+	}
+	if restart.MaxBackoffDuration < restart.InitialBackoffDuration {
+		return &ConfigError{Field: "ChildRestart.MaxBackoff", Message: "must not be less than InitialBackoff"}
 	}
 
-	if config.MilterListen.Address == "" {
-		return &ConfigError{Field: "MilterListen.Address", Message: "is not set"}
+	if restart.MaxCrashes == 0 {
+		restart.MaxCrashes = DefaultRestartMaxCrashes
 	}
+	if restart.MaxCrashes < 0 {
+		return &ConfigError{Field: "ChildRestart.MaxCrashes", Message: fmt.Sprintf("invalid value %d", restart.MaxCrashes)}
+	}
+	return nil
+}
 
-	if config.MilterListen.Mode == 0 {
-		config.MilterListen.Mode = 0600
+func validateConfig(config *Config) error {
+	if err := validateMilterListens(config); err != nil {
+		return err
 	}
 
-	if config.PidFile.Path == "" {
+	if config.PidFile.Path == "" && !config.Foreground {
 		return &ConfigError{Field: "PIDFile.Path", Message: "is not set"}
 	}
 
-	if config.ControlSocketFile.Path == "" {
+	if config.ControlSocketFile.Path == "" && !config.Foreground {
 		return &ConfigError{Field: "ControlSocketFile.Path", Message: "is not set"}
 	}
 
@@ -238,24 +594,84 @@ func validateConfig(config *Config) error {
 		config.LogFile.Mode = 0600
 	}
 
-	if len(config.MyNetworks) == 0 {
+	if len(config.MyNetworks) == 0 && config.MyNetworksFile == "" && len(config.InternalHosts) == 0 {
 		return &ConfigError{Field: "MyNetworks", Message: "is not set"}
 	}
 
-	for _, network := range config.MyNetworks {
-		_, ipNet, err := net.ParseCIDR(network)
-		if err != nil {
-			return err
+	myNetworks, err := parseCIDRs("MyNetworks", config.MyNetworks, config.MyNetworksFile)
+	if err != nil {
+		return err
+	}
+	config.ParsedMyNetworks = myNetworks
+
+	internalHosts, err := ParseNetworks("InternalHosts", config.InternalHosts)
+	if err != nil {
+		return err
+	}
+	config.ParsedInternalHosts = internalHosts
+
+	switch config.PartialBodyPolicy {
+	case "":
+		config.PartialBodyPolicy = PartialBodyPolicyAccept
+	case PartialBodyPolicyAccept, PartialBodyPolicyFlag, PartialBodyPolicyDowngrade:
+	default:
+		return &ConfigError{Field: "PartialBodyPolicy", Message: fmt.Sprintf(`invalid value "%s"`, config.PartialBodyPolicy)}
+	}
+
+	config.ShutdownTimeoutDuration = DefaultShutdownTimeout
+	if config.ShutdownTimeout != "" {
+		timeout, err := parseDuration(config.ShutdownTimeout)
+		if err != nil || timeout <= 0 {
+			return &ConfigError{Field: "ShutdownTimeout", Message: fmt.Sprintf(`invalid value "%s"`, config.ShutdownTimeout)}
 		}
-		config.ParsedMyNetworks = append(config.ParsedMyNetworks, ipNet)
+		config.ShutdownTimeoutDuration = timeout
+	}
+
+	if err := validateChildRestart(&config.ChildRestart); err != nil {
+		return err
+	}
+
+	if config.Workers == 0 {
+		config.Workers = 1
+	}
+	if config.Workers < 0 {
+		return &ConfigError{Field: "Workers", Message: fmt.Sprintf("invalid value %d", config.Workers)}
+	}
+	if config.MaxSessionsPerChild < 0 {
+		return &ConfigError{Field: "MaxSessionsPerChild", Message: fmt.Sprintf("invalid value %d", config.MaxSessionsPerChild)}
+	}
+
+	if config.ResignPolicy == "" {
+		config.ResignPolicy = ResignPolicyAny
+	}
+	if err := checkResignPolicy(config.ResignPolicy); err != nil {
+		return &ConfigError{Field: "ResignPolicy", Message: err.Error()}
+	}
+
+	domains, err := expandDomains(config.Domains)
+	if err != nil {
+		return err
+	}
+	config.Domains = domains
+
+	// 定義元ごとの重複チェック用
+	sources := make(map[string]string, len(config.Domains))
+	for domain := range config.Domains {
+		sources[domain] = "Domains"
+	}
+
+	if err := loadOpenDKIMTables(config, sources); err != nil {
+		return err
+	}
+
+	if err := loadDomainsDir(config, sources); err != nil {
+		return err
 	}
 
 	if len(config.Domains) == 0 {
 		return &ConfigError{Field: "Domains", Message: "is not set"}
 	}
 
-	config.Domains = expandDomains(config.Domains)
-
 	for domain, value := range config.Domains {
 		if value.HeaderCanonicalization == "" {
 			value.HeaderCanonicalization = DefaultHeaderCanonicalization
@@ -293,6 +709,41 @@ func validateConfig(config *Config) error {
 			value.ARCSelector = value.Selector
 		}
 
+		if value.SignatureTTL != "" {
+			ttl, err := parseDuration(value.SignatureTTL)
+			if err != nil || ttl <= 0 {
+				return &ConfigError{Field: fmt.Sprintf("Domains[%s].SignatureTTL", domain), Message: fmt.Sprintf(`invalid value "%s"`, value.SignatureTTL)}
+			}
+			value.SignatureTTLDuration = ttl
+		}
+
+		if err := checkAUID(value.AUID); err != nil {
+			return &ConfigError{Field: fmt.Sprintf("Domains[%s].AUID", domain), Message: err.Error()}
+		}
+
+		if value.ResignPolicy == "" {
+			value.ResignPolicy = config.ResignPolicy
+		}
+		if err := checkResignPolicy(value.ResignPolicy); err != nil {
+			return &ConfigError{Field: fmt.Sprintf("Domains[%s].ResignPolicy", domain), Message: err.Error()}
+		}
+
+		if len(value.ARCSignHeaders) == 0 {
+			value.ARCSignHeaders = config.ARCSignHeaders
+		}
+		if len(value.DKIMSignHeaders) == 0 {
+			value.DKIMSignHeaders = config.DKIMSignHeaders
+		}
+		if len(value.OversignHeaders) == 0 {
+			value.OversignHeaders = config.OversignHeaders
+		}
+
+		trusted, err := ParseNetworks(fmt.Sprintf("Domains[%s].TrustedNetworks", domain), value.TrustedNetworks)
+		if err != nil {
+			return err
+		}
+		value.ParsedTrustedNetworks = trusted
+
 		if value.Pattern == "" {
 			value.Pattern = domain
 		}
@@ -301,6 +752,13 @@ func validateConfig(config *Config) error {
 		config.Domains[domain] = value
 	}
 
+	regexps, err := compileDomainRegexps(config.Domains)
+	if err != nil {
+		return err
+	}
+	config.domainRegexps = regexps
+	config.domainIndex = newDomainIndex(config.Domains)
+
 	uid, err := getUid(config.User)
 	if err != nil {
 		return err
@@ -324,12 +782,18 @@ func validateConfig(config *Config) error {
 	return nil
 }
 
-func loadKeys(config *Config) error {
+func loadKeys(config *Config, keys map[string][]byte) error {
+	config.keyFiles = make(map[string][]byte)
 	for domain, value := range config.Domains {
-		buf, err := os.ReadFile(value.PrivateKeyFile)
-		if err != nil {
-			return err
+		var err error
+		buf, ok := keys[value.PrivateKeyFile]
+		if !ok {
+			buf, err = os.ReadFile(value.PrivateKeyFile)
+			if err != nil {
+				return err
+			}
 		}
+		config.keyFiles[value.PrivateKeyFile] = buf
 		block, _ := pem.Decode(buf)
 		if block == nil {
 			return fmt.Errorf("failed to decode pem: %s", value.PrivateKeyFile)
@@ -366,10 +830,40 @@ func loadKeys(config *Config) error {
 	return nil
 }
 
+// KeyFiles は読み込んだ秘密鍵ファイルの内容を PrivateKeyFile ごとに返す
+func (c *Config) KeyFiles() map[string][]byte {
+	return c.keyFiles
+}
+
 // IsMyNetwork は指定された IP アドレスが自分のネットワークに含まれるかを返す
 func (c *Config) IsMyNetwork(ip net.IP) bool {
-	for _, ipNet := range c.ParsedMyNetworks {
-		if ipNet.Contains(ip) {
+	return c.ParsedMyNetworks.Contains(ip, "")
+}
+
+// IsInternalHost は接続元が MyNetworks もしくは InternalHosts に含まれるかを返す
+// hostname は MTA が確認した接続元のホスト名で、不明な場合は空を指定する
+func (c *Config) IsInternalHost(ip net.IP, hostname string) bool {
+	return c.IsMyNetwork(ip) || c.ParsedInternalHosts.Contains(ip, hostname)
+}
+
+// IsTrustedNetwork は接続元がいずれかのドメインの TrustedNetworks に含まれるかを返す
+func (c *Config) IsTrustedNetwork(ip net.IP, hostname string) bool {
+	for _, d := range c.Domains {
+		if d.ParsedTrustedNetworks.Contains(ip, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasHostPatterns は InternalHosts もしくはいずれかのドメインの TrustedNetworks がホスト名のパターンを含むかを返す
+// 含まない場合は接続元のホスト名を確認する必要がない
+func (c *Config) HasHostPatterns() bool {
+	if c.ParsedInternalHosts.HasHosts() {
+		return true
+	}
+	for _, d := range c.Domains {
+		if d.ParsedTrustedNetworks.HasHosts() {
 			return true
 		}
 	}
@@ -409,45 +903,159 @@ func matchDomain(pattern string, domain string) bool {
 	return strings.HasSuffix(domain, "."+hostPart) || domain == hostPart
 }
 
-// expandDomains は簡略構文 "list:domain1,domain2,*.domain3" を展開する
-func expandDomains(domains map[string]Domain) map[string]Domain {
+// expandDomains は簡略構文 "list:domain1,domain2,*.domain3" と
+// ドメインパターンを1行ずつ記述したファイルを指定する "file:/path/to/domains" を展開する
+func expandDomains(domains map[string]Domain) (map[string]Domain, error) {
 	result := make(map[string]Domain)
 
 	for domainKey, domainConf := range domains {
-		if strings.HasPrefix(domainKey, "list:") {
-			domainList := strings.Split(domainKey[5:], ",")
-			for _, d := range domainList {
-				d = strings.TrimSpace(d)
-				if d == "" {
-					continue
-				}
-				domainCopy := domainConf
-				domainCopy.Domain = d
-				domainCopy.Pattern = d
-				result[d] = domainCopy
+		var domainList []string
+		switch {
+		case strings.HasPrefix(domainKey, domainListPrefix):
+			domainList = strings.Split(domainKey[len(domainListPrefix):], ",")
+		case strings.HasPrefix(domainKey, domainFilePrefix):
+			list, err := readDomainList(domainKey[len(domainFilePrefix):])
+			if err != nil {
+				return nil, &ConfigError{Field: fmt.Sprintf("Domains[%s]", domainKey), Message: err.Error()}
+			}
+			domainList = list
+		default:
+			continue
+		}
+		for _, d := range domainList {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
 			}
+			domainCopy := domainConf
+			domainCopy.Domain = d
+			domainCopy.Pattern = d
+			result[d] = domainCopy
 		}
 	}
 
 	for domainKey, domainConf := range domains {
-		if !strings.HasPrefix(domainKey, "list:") {
+		if !strings.HasPrefix(domainKey, domainListPrefix) && !strings.HasPrefix(domainKey, domainFilePrefix) {
 			domainConf.Domain = domainKey
 			domainConf.Pattern = domainKey
 			result[domainKey] = domainConf
 		}
 	}
 
-	return result
+	return result, nil
+}
+
+// readDomainList はドメインパターンを1行ずつ記述したファイルを読み込む
+// "#" 以降はコメントとして扱い、1行に空白区切りで複数のパターンを記述できる
+func readDomainList(path string) ([]string, error) {
+	var list []string
+	err := readTableLines(path, func(line int, fields []string) error {
+		for _, d := range fields {
+			if strings.HasPrefix(d, domainListPrefix) || strings.HasPrefix(d, domainFilePrefix) {
+				return fmt.Errorf(`%s:%d: invalid domain pattern "%s"`, path, line, d)
+			}
+			list = append(list, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// domainRegexp は "regex:" で始まるドメインパターンとコンパイルした正規表現の組
+type domainRegexp struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// compileDomainRegexps は Domains の "regex:" で始まるパターンをコンパイルし、パターン順に並べて返す
+func compileDomainRegexps(domains map[string]Domain) ([]domainRegexp, error) {
+	var regexps []domainRegexp
+	for pattern := range domains {
+		if !strings.HasPrefix(pattern, domainRegexpPrefix) {
+			continue
+		}
+		expr := pattern[len(domainRegexpPrefix):]
+		if expr == "" {
+			return nil, &ConfigError{Field: fmt.Sprintf("Domains[%s]", pattern), Message: "regular expression is empty"}
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, &ConfigError{Field: fmt.Sprintf("Domains[%s]", pattern), Message: err.Error()}
+		}
+		regexps = append(regexps, domainRegexp{pattern: pattern, re: re})
+	}
+	sort.Slice(regexps, func(i, j int) bool {
+		return regexps[i].pattern < regexps[j].pattern
+	})
+	return regexps, nil
+}
+
+// IsTrustedSender は接続元にこのドメインの DKIM 署名を許可するかを返す
+// TrustedNetworks を指定していない場合は常に許可する
+func (d *Domain) IsTrustedSender(ip net.IP, hostname string) bool {
+	return d.ParsedTrustedNetworks.IsEmpty() || d.ParsedTrustedNetworks.Contains(ip, hostname)
+}
+
+// IsSignatureTimestamp は DKIM 署名に t= を含めるかを返す
+func (d *Domain) IsSignatureTimestamp() bool {
+	return d.SignatureTimestamp == nil || *d.SignatureTimestamp
+}
+
+// signingDomain は DKIM 署名に使用するドメインを返す
+func (d *Domain) signingDomain(matched string) string {
+	if d.SigningDomain != "" {
+		return d.SigningDomain
+	}
+	return matched
 }
 
 // GetMatchingDomain は対象ドメインに最もマッチするドメイン設定を返す
-// 優先順位：完全一致 → ワイルドカード一致（より限定的なもの優先） → デフォルト(*)
-// 返される Domain の Domain フィールドは、マッチした実際のドメイン名に設定される
+// 優先順位：完全一致 → ワイルドカード一致（より限定的なもの優先） → 正規表現一致（パターンの辞書順） → デフォルト(*)
+// 返される Domain の Domain フィールドは、マッチした実際のドメイン名 (SigningDomain があればその値) に設定される
 func (c *Config) GetMatchingDomain(domain string) (*Domain, bool) {
 	if d, ok := c.Domains[domain]; ok {
+		d.Domain = d.signingDomain(d.Domain)
+		return &d, true
+	}
+
+	var bestMatchKey string
+	if c.domainIndex != nil {
+		bestMatchKey = c.domainIndex.lookup(domain)
+	} else {
+		bestMatchKey = c.matchWildcardLinear(domain)
+	}
+
+	if bestMatchKey != "" {
+		if d, ok := c.Domains[bestMatchKey]; ok {
+			d.Domain = d.signingDomain(domain)
+			return &d, true
+		}
+	}
+
+	for _, r := range c.domainRegexps {
+		if !r.re.MatchString(domain) {
+			continue
+		}
+		if d, ok := c.Domains[r.pattern]; ok {
+			d.Domain = d.signingDomain(domain)
+			return &d, true
+		}
+	}
+
+	if d, ok := c.Domains["*"]; ok {
+		d.Domain = d.signingDomain(domain)
 		return &d, true
 	}
 
+	return nil, false
+}
+
+// matchWildcardLinear は全てのパターンを順に比較し、domain にマッチするワイルドカードのパターンのうち
+// ホスト部が最も長いものを返す
+func (c *Config) matchWildcardLinear(domain string) string {
 	bestMatchKey := ""
 	bestMatchLen := 0
 
@@ -455,8 +1063,11 @@ func (c *Config) GetMatchingDomain(domain string) (*Domain, bool) {
 		if pattern == "*" {
 			continue
 		}
+		isWildcard, hostPart := parseDomainPattern(pattern)
+		if !isWildcard {
+			continue
+		}
 		if matchDomain(pattern, domain) {
-			_, hostPart := parseDomainPattern(pattern)
 			matchLen := len(hostPart)
 			if matchLen > bestMatchLen {
 				bestMatchKey = pattern
@@ -465,17 +1076,5 @@ func (c *Config) GetMatchingDomain(domain string) (*Domain, bool) {
 		}
 	}
 
-	if bestMatchKey != "" {
-		if d, ok := c.Domains[bestMatchKey]; ok {
-			d.Domain = domain
-			return &d, true
-		}
-	}
-
-	if d, ok := c.Domains["*"]; ok {
-		d.Domain = domain
-		return &d, true
-	}
-
-	return nil, false
+	return bestMatchKey
 }
@@ -1,9 +1,17 @@
 package config
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_getUid(t *testing.T) {
@@ -159,6 +167,358 @@ func Test_checkMilterListenNetwork(t *testing.T) {
 	}
 }
 
+func Test_validateMilterListens(t *testing.T) {
+	testCase := []struct {
+		name      string
+		config    Config
+		expected  []string
+		policies  []string
+		expectErr bool
+	}{
+		{
+			name: "single",
+			config: Config{
+				MilterListen: MilterListen{Network: "tcp", Address: "127.0.0.1:10029"},
+			},
+			expected: []string{"127.0.0.1:10029"},
+			policies: []string{"both"},
+		},
+		{
+			name: "MilterListen and MilterListens",
+			config: Config{
+				MilterListen: MilterListen{Network: "tcp", Address: "127.0.0.1:10029", Policy: "verify"},
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10030", Policy: "sign"},
+				},
+			},
+			expected: []string{"127.0.0.1:10029", "127.0.0.1:10030"},
+			policies: []string{"verify", "sign"},
+		},
+		{
+			name: "MilterListens only",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10029"},
+					{Network: "tcp", Address: "127.0.0.1:10030", Policy: "sign"},
+				},
+			},
+			expected: []string{"127.0.0.1:10029", "127.0.0.1:10030"},
+			policies: []string{"both", "sign"},
+		},
+		{
+			name: "duplicate address",
+			config: Config{
+				MilterListen: MilterListen{Network: "tcp", Address: "127.0.0.1:10029"},
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10029"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid policy",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10029", Policy: "arc"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "SMTP proxy",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10025", Protocol: "smtp", NextHop: "127.0.0.1:10026"},
+				},
+			},
+			expected: []string{"127.0.0.1:10025"},
+			policies: []string{"both"},
+		},
+		{
+			name: "invalid protocol",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10029", Protocol: "lmtp"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "SMTP proxy without NextHop",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10025", Protocol: "smtp"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "invalid NextHop",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10025", Protocol: "smtp", NextHop: "127.0.0.1"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name: "NextHop with milter",
+			config: Config{
+				MilterListens: []MilterListen{
+					{Network: "tcp", Address: "127.0.0.1:10029", NextHop: "127.0.0.1:10026"},
+				},
+			},
+			expectErr: true,
+		},
+		{
+			name:      "not set",
+			config:    Config{},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateMilterListens(&tc.config)
+			if err != nil && !tc.expectErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Fatalf("expected error, but got nil")
+			}
+			if tc.expectErr {
+				return
+			}
+			if len(tc.config.MilterListens) != len(tc.expected) {
+				t.Fatalf("expected %d listens, got %d", len(tc.expected), len(tc.config.MilterListens))
+			}
+			for i, listen := range tc.config.MilterListens {
+				if listen.Address != tc.expected[i] {
+					t.Errorf("expected address %s, got %s", tc.expected[i], listen.Address)
+				}
+				if listen.Policy != tc.policies[i] {
+					t.Errorf("expected policy %s, got %s", tc.policies[i], listen.Policy)
+				}
+			}
+			if tc.config.MilterListen.Address != tc.expected[0] {
+				t.Errorf("expected MilterListen %s, got %s", tc.expected[0], tc.config.MilterListen.Address)
+			}
+		})
+	}
+}
+
+func Test_checkSigningIdentity(t *testing.T) {
+	testCase := []struct {
+		name      string
+		identity  string
+		expectErr bool
+	}{
+		{
+			name:      "from",
+			identity:  "from",
+			expectErr: false,
+		},
+		{
+			name:      "mail-from",
+			identity:  "mail-from",
+			expectErr: false,
+		},
+		{
+			name:      "auth",
+			identity:  "auth",
+			expectErr: false,
+		},
+		{
+			name:      "header",
+			identity:  "header:Sender",
+			expectErr: false,
+		},
+		{
+			name:      "header without name",
+			identity:  "header:",
+			expectErr: true,
+		},
+		{
+			name:      "invalid",
+			identity:  "envelope",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkSigningIdentity(tc.identity)
+			if err != nil && !tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Errorf("expected error, but got nil")
+			}
+		})
+	}
+}
+
+func Test_checkAUID(t *testing.T) {
+	testCase := []struct {
+		name      string
+		auid      string
+		expectErr bool
+	}{
+		{
+			name: "empty",
+			auid: "",
+		},
+		{
+			name: "from",
+			auid: "from",
+		},
+		{
+			name: "auth",
+			auid: "auth",
+		},
+		{
+			name: "template",
+			auid: "{local}@{subdomain}.example.jp",
+		},
+		{
+			name:      "template without @",
+			auid:      "{local}.example.jp",
+			expectErr: true,
+		},
+		{
+			name:      "unknown placeholder",
+			auid:      "{user}@example.jp",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkAUID(tc.auid)
+			if err != nil && !tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Errorf("expected error, but got nil")
+			}
+		})
+	}
+}
+
+func Test_parseDuration(t *testing.T) {
+	testCase := []struct {
+		name      string
+		value     string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{
+			name:     "days",
+			value:    "7d",
+			expected: 7 * 24 * time.Hour,
+		},
+		{
+			name:     "hours",
+			value:    "36h",
+			expected: 36 * time.Hour,
+		},
+		{
+			name:      "invalid days",
+			value:     "xd",
+			expectErr: true,
+		},
+		{
+			name:      "invalid",
+			value:     "7",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := parseDuration(tc.value)
+			if err != nil && !tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Errorf("expected error, but got nil")
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_validateChildRestart(t *testing.T) {
+	testCase := []struct {
+		name      string
+		restart   ChildRestart
+		expected  ChildRestart
+		expectErr bool
+	}{
+		{
+			name:    "default",
+			restart: ChildRestart{},
+			expected: ChildRestart{
+				MaxCrashes:             DefaultRestartMaxCrashes,
+				InitialBackoffDuration: DefaultRestartInitialBackoff,
+				MaxBackoffDuration:     DefaultRestartMaxBackoff,
+				CrashWindowDuration:    DefaultRestartCrashWindow,
+			},
+		},
+		{
+			name: "custom",
+			restart: ChildRestart{
+				InitialBackoff: "500ms",
+				MaxBackoff:     "30s",
+				MaxCrashes:     3,
+				CrashWindow:    "1d",
+			},
+			expected: ChildRestart{
+				InitialBackoff:         "500ms",
+				MaxBackoff:             "30s",
+				MaxCrashes:             3,
+				CrashWindow:            "1d",
+				InitialBackoffDuration: 500 * time.Millisecond,
+				MaxBackoffDuration:     30 * time.Second,
+				CrashWindowDuration:    24 * time.Hour,
+			},
+		},
+		{
+			name:      "invalid duration",
+			restart:   ChildRestart{InitialBackoff: "1"},
+			expectErr: true,
+		},
+		{
+			name:      "max backoff less than initial backoff",
+			restart:   ChildRestart{InitialBackoff: "2m", MaxBackoff: "1m"},
+			expectErr: true,
+		},
+		{
+			name:      "negative max crashes",
+			restart:   ChildRestart{MaxCrashes: -1},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCase {
+		t.Run(tc.name, func(t *testing.T) {
+			restart := tc.restart
+			err := validateChildRestart(&restart)
+			if err != nil && !tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Errorf("expected error, but got nil")
+			}
+			if err == nil && restart != tc.expected {
+				t.Errorf("expected %+v, got %+v", tc.expected, restart)
+			}
+		})
+	}
+}
+
 func Test_parseDomainPattern(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -294,7 +654,10 @@ func Test_expandDomains(t *testing.T) {
 		},
 	}
 
-	result := expandDomains(input)
+	result, err := expandDomains(input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 
 	// 展開されたエントリを確認
 	if len(result) != 3 {
@@ -391,7 +754,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			domain, ok := testConfig.GetMatchingDomain(tc.domain)
+			domain, ok := getMatchingDomain(t, testConfig, tc.domain)
 			if !ok {
 				t.Errorf("domain %s: expected match, got none", tc.domain)
 				return
@@ -436,7 +799,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 	}
 
 	t.Run("deep wildcard priority", func(t *testing.T) {
-		d, ok := deepWildcardConfig.GetMatchingDomain("sub.deep.example.com")
+		d, ok := getMatchingDomain(t, deepWildcardConfig, "sub.deep.example.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.deep.example.com" {
@@ -445,7 +808,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 	})
 
 	t.Run("wildcard priority over deep wildcard", func(t *testing.T) {
-		d, ok := deepWildcardConfig.GetMatchingDomain("sub.example.com")
+		d, ok := getMatchingDomain(t, deepWildcardConfig, "sub.example.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.example.com" {
@@ -454,7 +817,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 	})
 
 	t.Run("exact priority over wildcard", func(t *testing.T) {
-		d, ok := deepWildcardConfig.GetMatchingDomain("example.com")
+		d, ok := getMatchingDomain(t, deepWildcardConfig, "example.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "example.com" {
@@ -463,7 +826,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 	})
 
 	t.Run("default wildcard fallback", func(t *testing.T) {
-		d, ok := deepWildcardConfig.GetMatchingDomain("random.com")
+		d, ok := getMatchingDomain(t, deepWildcardConfig, "random.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*" {
@@ -491,7 +854,7 @@ func Test_GetMatchingDomain(t *testing.T) {
 				},
 			},
 		}
-		_, ok := noDefaultConfig.GetMatchingDomain("nonexistent.example.org")
+		_, ok := getMatchingDomain(t, noDefaultConfig, "nonexistent.example.org")
 		if ok {
 			t.Error("expected no match")
 		}
@@ -538,28 +901,28 @@ func Test_GetMatchingDomain(t *testing.T) {
 			},
 		}
 
-		d, ok := multiConfig.GetMatchingDomain("mail.sub.example.com")
+		d, ok := getMatchingDomain(t, multiConfig, "mail.sub.example.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.example.com" {
 			t.Errorf("expected pattern *.example.com, got %s", d.Pattern)
 		}
 
-		d, ok = multiConfig.GetMatchingDomain("mail.sub.deep.example.com")
+		d, ok = getMatchingDomain(t, multiConfig, "mail.sub.deep.example.com")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.deep.example.com" {
 			t.Errorf("expected pattern *.deep.example.com, got %s", d.Pattern)
 		}
 
-		d, ok = multiConfig.GetMatchingDomain("mail.example.jp")
+		d, ok = getMatchingDomain(t, multiConfig, "mail.example.jp")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.example.jp" {
 			t.Errorf("expected pattern *.example.jp, got %s", d.Pattern)
 		}
 
-		d, ok = multiConfig.GetMatchingDomain("mail.sub.deep.example.jp")
+		d, ok = getMatchingDomain(t, multiConfig, "mail.sub.deep.example.jp")
 		if !ok {
 			t.Error("expected match")
 		} else if d.Pattern != "*.deep.example.jp" {
@@ -567,3 +930,177 @@ func Test_GetMatchingDomain(t *testing.T) {
 		}
 	})
 }
+
+func Test_expandDomains_file(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	valid := write("valid", "# hosted domains\nexample.com\n\nmail.example.com *.example.net # trailing comment\n")
+	nested := write("nested", "example.com\nlist:example.net\n")
+
+	result, err := expandDomains(map[string]Domain{
+		"file:" + valid: {Selector: "hosted"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 3 {
+		t.Errorf("expected 3 domains, got %d", len(result))
+	}
+	for _, domain := range []string{"example.com", "mail.example.com", "*.example.net"} {
+		if d, ok := result[domain]; !ok {
+			t.Errorf("domain %s not found in result", domain)
+		} else if d.Selector != "hosted" || d.Pattern != domain {
+			t.Errorf("domain %s: unexpected domain: %+v", domain, d)
+		}
+	}
+
+	for name, path := range map[string]string{
+		"nested pattern": nested,
+		"missing file":   filepath.Join(dir, "missing"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := expandDomains(map[string]Domain{"file:" + path: {}})
+			if err == nil || !strings.Contains(err.Error(), path) {
+				t.Errorf("expected error containing %s, got %v", path, err)
+			}
+		})
+	}
+}
+
+func Test_GetMatchingDomain_regex(t *testing.T) {
+	domains := map[string]Domain{
+		"mx1.tenant.example":                {Domain: "mx1.tenant.example", Pattern: "mx1.tenant.example", Selector: "exact"},
+		"*.relay.tenant.example":            {Pattern: "*.relay.tenant.example", Selector: "wildcard"},
+		`regex:^mx[0-9]+\.tenant\.example$`: {Pattern: `regex:^mx[0-9]+\.tenant\.example$`, Selector: "mx"},
+		`regex:^smtp[0-9]+\.`:               {Pattern: `regex:^smtp[0-9]+\.`, Selector: "smtp"},
+		`regex:tenant\.example$`:            {Pattern: `regex:tenant\.example$`, Selector: "tenant"},
+		"*":                                 {Pattern: "*", Selector: "default"},
+	}
+	regexps, err := compileDomainRegexps(domains)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testConfig := &Config{Domains: domains, domainRegexps: regexps}
+
+	testCases := []struct {
+		name           string
+		domain         string
+		expectSelector string
+	}{
+		{name: "exact match takes priority over regex", domain: "mx1.tenant.example", expectSelector: "exact"},
+		{name: "wildcard match takes priority over regex", domain: "mx2.relay.tenant.example", expectSelector: "wildcard"},
+		{name: "regex match", domain: "mx2.tenant.example", expectSelector: "mx"},
+		{name: "first regex in pattern order", domain: "mx10.tenant.example", expectSelector: "mx"},
+		{name: "other regex", domain: "smtp1.example.jp", expectSelector: "smtp"},
+		{name: "regex is not anchored", domain: "mx.tenant.example", expectSelector: "tenant"},
+		{name: "default", domain: "mx1.example.jp", expectSelector: "default"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, ok := getMatchingDomain(t, testConfig, tc.domain)
+			if !ok {
+				t.Fatalf("domain %s: expected match, got none", tc.domain)
+			}
+			if d.Selector != tc.expectSelector {
+				t.Errorf("domain %s: expected selector %s, got %s", tc.domain, tc.expectSelector, d.Selector)
+			}
+			if d.Domain != tc.domain {
+				t.Errorf("expected Domain=%s, got %s", tc.domain, d.Domain)
+			}
+		})
+	}
+
+	for _, pattern := range []string{"regex:", "regex:^mx[0-9+$"} {
+		if _, err := compileDomainRegexps(map[string]Domain{pattern: {}}); err == nil {
+			t.Errorf("%s: expected error, but got nil", pattern)
+		}
+	}
+}
+
+func Test_LoadWithKeys(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	dir := t.TempDir()
+	// 秘密鍵ファイルは作成せず、keys からのみ読み込めるようにする
+	keyPath := filepath.Join(dir, "example.jp.key")
+	path := filepath.Join(dir, "arcmilter.yaml")
+	conf := `MilterListen:
+  Network: unix
+  Address: ` + filepath.Join(dir, "arcmilter.sock") + `
+ControlSocketFile:
+  Path: ` + filepath.Join(dir, "arcmilterctl.sock") + `
+PIDFile:
+  Path: ` + filepath.Join(dir, "arcmilter.pid") + `
+MyNetworks:
+  - 127.0.0.0/8
+Domains:
+  "example.jp":
+    Selector: "default"
+    PrivateKeyFile: "` + keyPath + `"
+ARCSignHeaders:
+  - "From"
+DKIMSignHeaders:
+  - "From"
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		keys      map[string][]byte
+		expectErr bool
+	}{
+		{
+			name:      "key from keys",
+			keys:      map[string][]byte{keyPath: pemKey},
+			expectErr: false,
+		},
+		{
+			name:      "key not in keys",
+			keys:      map[string][]byte{filepath.Join(dir, "other.key"): pemKey},
+			expectErr: true,
+		},
+		{
+			name:      "nil keys",
+			keys:      nil,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := LoadWithKeys(path, tc.keys)
+			if tc.expectErr {
+				if err == nil || !strings.Contains(err.Error(), keyPath) {
+					t.Fatalf("expected error reading %s, got %v", keyPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !priv.Equal(c.Domains["example.jp"].PrivateKeySigner) {
+				t.Errorf("private key does not match")
+			}
+			if string(c.KeyFiles()[keyPath]) != string(pemKey) {
+				t.Errorf("key file is not recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"strings"
+)
+
+// domainIndex はワイルドカードのドメインパターンをラベルを逆順にした木で保持し、
+// 対象ドメインに最も限定的にマッチするパターンをラベル数に比例する時間で探す
+type domainIndex struct {
+	root domainIndexNode
+}
+
+type domainIndexNode struct {
+	children map[string]*domainIndexNode
+	// このノードまでのラベルをホスト部とするワイルドカードのパターン ("*.example.jp")
+	pattern string
+}
+
+// newDomainIndex は Domains のワイルドカードのパターンから domainIndex を作成する
+// 完全一致、正規表現とデフォルト(*)のパターンは含めない
+func newDomainIndex(domains map[string]Domain) *domainIndex {
+	idx := &domainIndex{}
+	for pattern := range domains {
+		if pattern == "*" {
+			continue
+		}
+		isWildcard, hostPart := parseDomainPattern(pattern)
+		// ホスト部が空のパターン ("*.") は全体の比較でも選ばれないため含めない
+		if !isWildcard || hostPart == "" {
+			continue
+		}
+		idx.insert(pattern, hostPart)
+	}
+	return idx
+}
+
+// insert は hostPart のラベルを末尾から順にたどり、最後のノードに pattern を登録する
+func (idx *domainIndex) insert(pattern, hostPart string) {
+	node := &idx.root
+	rest := hostPart
+	for {
+		i := strings.LastIndexByte(rest, '.')
+		label := rest[i+1:]
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*domainIndexNode)
+			}
+			child = &domainIndexNode{}
+			node.children[label] = child
+		}
+		node = child
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+	node.pattern = pattern
+}
+
+// lookup は domain にマッチするワイルドカードのパターンのうちホスト部が最も長いものを返す
+// マッチするパターンがない場合は空を返す
+func (idx *domainIndex) lookup(domain string) string {
+	best := ""
+	node := &idx.root
+	rest := domain
+	for {
+		i := strings.LastIndexByte(rest, '.')
+		node = node.children[rest[i+1:]]
+		if node == nil {
+			break
+		}
+		if node.pattern != "" {
+			best = node.pattern
+		}
+		if i < 0 {
+			break
+		}
+		rest = rest[:i]
+	}
+	return best
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"testing"
+)
+
+// getMatchingDomain は c の Domains から索引を作成した場合と作成しない場合の GetMatchingDomain の結果が
+// 一致することを確認し、索引を作成しない場合の結果を返す
+func getMatchingDomain(t *testing.T, c *Config, domain string) (*Domain, bool) {
+	t.Helper()
+	linear := &Config{Domains: c.Domains, domainRegexps: c.domainRegexps}
+	indexed := &Config{Domains: c.Domains, domainRegexps: c.domainRegexps, domainIndex: newDomainIndex(c.Domains)}
+	expected, expectedOK := linear.GetMatchingDomain(domain)
+	got, ok := indexed.GetMatchingDomain(domain)
+	if ok != expectedOK || ok && (got.Pattern != expected.Pattern || got.Domain != expected.Domain) {
+		t.Errorf("domain %s: index returned %+v, expected %+v", domain, got, expected)
+	}
+	return expected, expectedOK
+}
+
+// hostedDomains は n 個の顧客ドメインの完全一致とワイルドカードのパターンを生成する
+func hostedDomains(n int) map[string]Domain {
+	domains := make(map[string]Domain, 2*n+1)
+	for i := 0; i < n; i++ {
+		exact := fmt.Sprintf("customer%d.example.jp", i)
+		wildcard := fmt.Sprintf("*.customer%d.example.net", i)
+		domains[exact] = Domain{Domain: exact, Pattern: exact}
+		domains[wildcard] = Domain{Domain: wildcard, Pattern: wildcard}
+	}
+	domains["*"] = Domain{Domain: "*", Pattern: "*"}
+	return domains
+}
+
+func BenchmarkGetMatchingDomain_Index(b *testing.B) {
+	domains := hostedDomains(20000)
+	c := &Config{Domains: domains, domainIndex: newDomainIndex(domains)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetMatchingDomain(fmt.Sprintf("mail.customer%d.example.net", i%20000))
+	}
+}
+
+func BenchmarkGetMatchingDomain_Linear(b *testing.B) {
+	c := &Config{Domains: hostedDomains(20000)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetMatchingDomain(fmt.Sprintf("mail.customer%d.example.net", i%20000))
+	}
+}
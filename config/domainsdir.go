@@ -0,0 +1,90 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// domainFile は DomainsDir 内の1ファイル分のドメイン設定を表す
+// Pattern を省略した場合はファイル名から拡張子を除いたものをパターンとする
+type domainFile struct {
+	Pattern string `yaml:"Pattern"`
+	Domain  `yaml:",inline"`
+}
+
+// isDomainFile は DomainsDir 内で読み込み対象とするファイルか判定する
+func isDomainFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseDomainFile はドメイン設定ファイルを読み込みパターンとドメイン設定の組を返す
+func parseDomainFile(path string) (map[string]Domain, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(strings.TrimSpace(string(buf))) == 0 {
+		return nil, fmt.Errorf("empty domain file")
+	}
+
+	var df domainFile
+	if err := yaml.Unmarshal(buf, &df); err != nil {
+		return nil, err
+	}
+
+	pattern := df.Pattern
+	if pattern == "" {
+		name := filepath.Base(path)
+		pattern = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+
+	return expandDomains(map[string]Domain{pattern: df.Domain})
+}
+
+// loadDomainsDir は DomainsDir 内のファイルからドメイン設定を読み込み Domains に統合する
+func loadDomainsDir(config *Config, sources map[string]string) error {
+	if config.DomainsDir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(config.DomainsDir)
+	if err != nil {
+		return &ConfigError{Field: "DomainsDir", Message: err.Error()}
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || !isDomainFile(entry.Name()) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		path := filepath.Join(config.DomainsDir, name)
+		domains, err := parseDomainFile(path)
+		if err != nil {
+			return &ConfigError{Field: "DomainsDir", Message: fmt.Sprintf("%s: %v", path, err)}
+		}
+		if err := mergeDomains(config.Domains, sources, domains, path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_loadDomainsDir(t *testing.T) {
+	writeFile := func(t *testing.T, path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+
+	t.Run("merge with inline Domains", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "example.jp.yaml"), "Selector: file\nDKIM: true\n")
+		writeFile(t, filepath.Join(dir, "customer.yml"), "Pattern: \"*.customer.jp\"\nSelector: customer\nARC: true\n")
+		writeFile(t, filepath.Join(dir, "README"), "not a domain file\n")
+		writeFile(t, filepath.Join(dir, ".example.net.yaml"), "Selector: hidden\n")
+
+		config := &Config{
+			Domains: map[string]Domain{
+				"inline.jp": {Selector: "inline"},
+			},
+			DomainsDir: dir,
+		}
+		sources := map[string]string{"inline.jp": "Domains"}
+		if err := loadDomainsDir(config, sources); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(config.Domains) != 3 {
+			t.Fatalf("expected 3 domains, got %d", len(config.Domains))
+		}
+		if d := config.Domains["example.jp"]; d.Selector != "file" || !d.DKIM || d.Pattern != "example.jp" {
+			t.Errorf("unexpected domain: %+v", d)
+		}
+		if d := config.Domains["*.customer.jp"]; d.Selector != "customer" || !d.ARC {
+			t.Errorf("unexpected domain: %+v", d)
+		}
+	})
+
+	t.Run("duplicate across files", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "a.yaml"), "Pattern: example.jp\nSelector: a\n")
+		writeFile(t, filepath.Join(dir, "b.yaml"), "Pattern: example.jp\nSelector: b\n")
+
+		config := &Config{Domains: map[string]Domain{}, DomainsDir: dir}
+		err := loadDomainsDir(config, map[string]string{})
+		if err == nil {
+			t.Fatalf("expected error, but got nil")
+		}
+		if !strings.Contains(err.Error(), "a.yaml") || !strings.Contains(err.Error(), "b.yaml") {
+			t.Errorf("error does not name both files: %v", err)
+		}
+	})
+
+	t.Run("duplicate with inline Domains", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "example.jp.yaml"), "Selector: file\n")
+
+		config := &Config{
+			Domains:    map[string]Domain{"example.jp": {Selector: "inline"}},
+			DomainsDir: dir,
+		}
+		if err := loadDomainsDir(config, map[string]string{"example.jp": "Domains"}); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		dir := t.TempDir()
+		writeFile(t, filepath.Join(dir, "example.jp.yaml"), "")
+
+		config := &Config{Domains: map[string]Domain{}, DomainsDir: dir}
+		err := loadDomainsDir(config, map[string]string{})
+		if err == nil || !strings.Contains(err.Error(), "example.jp.yaml") {
+			t.Errorf("expected error naming the file, got %v", err)
+		}
+	})
+}
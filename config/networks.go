@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Networks は接続元の IP アドレスの範囲とホスト名のパターンの一覧
+type Networks struct {
+	ipNets prefixTree
+	// 接続元のホスト名のパターン ("mail.example.jp" もしくは "*.example.jp")
+	hosts []string
+}
+
+// ParseNetworks は CIDR、IP アドレスもしくはホスト名のパターンの一覧を解析する
+// field はエラーの際に ConfigError に含める設定項目の名前
+func ParseNetworks(field string, entries []string) (Networks, error) {
+	var n Networks
+	for _, entry := range entries {
+		if err := n.add(entry, true); err != nil {
+			return Networks{}, &ConfigError{Field: field, Message: err.Error()}
+		}
+	}
+	return n, nil
+}
+
+// parseCIDRs は CIDR もしくは IP アドレスの一覧を解析する
+// MyNetworksFile が指定されている場合はそのファイルの各行の CIDR も含める
+func parseCIDRs(field string, entries []string, path string) (Networks, error) {
+	var n Networks
+	for _, entry := range entries {
+		if err := n.add(entry, false); err != nil {
+			return Networks{}, &ConfigError{Field: field, Message: err.Error()}
+		}
+	}
+	if path == "" {
+		return n, nil
+	}
+	err := readTableLines(path, func(line int, fields []string) error {
+		for _, entry := range fields {
+			if err := n.add(entry, false); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, line, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Networks{}, &ConfigError{Field: field + "File", Message: err.Error()}
+	}
+	return n, nil
+}
+
+// add は CIDR、IP アドレスもしくは allowHost の場合はホスト名のパターンを追加する
+func (n *Networks) add(entry string, allowHost bool) error {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf(`invalid CIDR "%s"`, entry)
+		}
+		n.ipNets.Insert(ipNet)
+		return nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		n.ipNets.Insert(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	host := normalizeHostname(entry)
+	if !allowHost || !isHostPattern(host) {
+		return fmt.Errorf(`invalid value "%s"`, entry)
+	}
+	n.hosts = append(n.hosts, host)
+	return nil
+}
+
+// normalizeHostname はホスト名を小文字にして末尾の "." を取り除く
+func normalizeHostname(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// isHostPattern はホスト名もしくは "*." で始まるホスト名のパターンかを返す
+func isHostPattern(pattern string) bool {
+	host := strings.TrimPrefix(pattern, "*.")
+	if host == "" {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// IsEmpty は一覧が空かを返す
+func (n *Networks) IsEmpty() bool {
+	return n.ipNets.Len() == 0 && len(n.hosts) == 0
+}
+
+// HasHosts はホスト名のパターンを含むかを返す
+func (n *Networks) HasHosts() bool {
+	return len(n.hosts) > 0
+}
+
+// Contains は接続元の IP アドレス ip もしくはホスト名 hostname が一覧に含まれるかを返す
+// hostname は MTA が確認した接続元のホスト名で、不明な場合は空を指定する
+func (n *Networks) Contains(ip net.IP, hostname string) bool {
+	if ip != nil && n.ipNets.Contains(ip) {
+		return true
+	}
+	if hostname = normalizeHostname(hostname); hostname != "" {
+		for _, pattern := range n.hosts {
+			if matchDomain(pattern, hostname) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ParseNetworks(t *testing.T) {
+	testCases := []struct {
+		name          string
+		entries       []string
+		expectedNets  int
+		expectedHosts []string
+		expectErr     bool
+	}{
+		{
+			name:          "CIDR, IP address and hostname",
+			entries:       []string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.1", "2001:db8::1", "Relay.Example.JP.", "*.example.com"},
+			expectedNets:  4,
+			expectedHosts: []string{"relay.example.jp", "*.example.com"},
+		},
+		{
+			name:         "CIDR only",
+			entries:      []string{"192.0.2.0/24", "2001:db8::1"},
+			expectedNets: 2,
+		},
+		{
+			name:      "invalid CIDR",
+			entries:   []string{"192.0.2.0/33"},
+			expectErr: true,
+		},
+		{
+			name:      "invalid hostname",
+			entries:   []string{"relay example.jp"},
+			expectErr: true,
+		},
+		{
+			name:      "empty label",
+			entries:   []string{"relay..example.jp"},
+			expectErr: true,
+		},
+		{
+			name:      "wildcard only",
+			entries:   []string{"*."},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := ParseNetworks("TrustedNetworks", tc.entries)
+			if err != nil && !tc.expectErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Fatalf("expected error, but got nil")
+			}
+			if tc.expectErr {
+				return
+			}
+			if n.ipNets.Len() != tc.expectedNets {
+				t.Errorf("expected %d networks, got %d", tc.expectedNets, n.ipNets.Len())
+			}
+			if len(n.hosts) != len(tc.expectedHosts) {
+				t.Fatalf("expected hosts %v, got %v", tc.expectedHosts, n.hosts)
+			}
+			for i, host := range n.hosts {
+				if host != tc.expectedHosts[i] {
+					t.Errorf("expected host %s, got %s", tc.expectedHosts[i], host)
+				}
+			}
+			if n.HasHosts() != (len(tc.expectedHosts) > 0) {
+				t.Errorf("expected HasHosts %t, got %t", len(tc.expectedHosts) > 0, n.HasHosts())
+			}
+		})
+	}
+}
+
+func Test_Networks_Contains(t *testing.T) {
+	n, err := ParseNetworks("TrustedNetworks", []string{"192.0.2.0/24", "2001:db8::1", "relay.example.jp", "*.example.com"})
+	if err != nil {
+		t.Fatalf("failed to parse networks: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		ip       string
+		hostname string
+		expected bool
+	}{
+		{name: "IPv4 in CIDR", ip: "192.0.2.10", expected: true},
+		{name: "IPv4 out of CIDR", ip: "198.51.100.1", expected: false},
+		{name: "IPv6 address", ip: "2001:db8::1", expected: true},
+		{name: "other IPv6 address", ip: "2001:db8::2", expected: false},
+		{name: "hostname", ip: "198.51.100.1", hostname: "relay.example.jp", expected: true},
+		{name: "hostname case and trailing dot", ip: "198.51.100.1", hostname: "RELAY.example.jp.", expected: true},
+		{name: "wildcard hostname", ip: "198.51.100.1", hostname: "mx1.example.com", expected: true},
+		{name: "other hostname", ip: "198.51.100.1", hostname: "relay.example.net", expected: false},
+		{name: "suffix is not a label", ip: "198.51.100.1", hostname: "badrelay.example.jp", expected: false},
+		{name: "no address", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := n.Contains(net.ParseIP(tc.ip), tc.hostname); got != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, got)
+			}
+		})
+	}
+
+	var empty Networks
+	if !empty.IsEmpty() || empty.Contains(net.ParseIP("192.0.2.1"), "relay.example.jp") {
+		t.Errorf("empty networks must not contain any address")
+	}
+}
+
+func Test_parseCIDRs(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return path
+	}
+	valid := write("valid", "# customer ranges\n192.0.2.0/24\n\n2001:db8::/32 198.51.100.1 # trailing comment\n")
+	invalid := write("invalid", "192.0.2.0/24\n192.0.2.0/33\n")
+	hostname := write("hostname", "relay.example.jp\n")
+
+	testCases := []struct {
+		name         string
+		entries      []string
+		path         string
+		expectedNets int
+		expectedErr  string
+	}{
+		{name: "entries only", entries: []string{"127.0.0.0/8", "::1"}, expectedNets: 2},
+		{name: "entries and file", entries: []string{"127.0.0.0/8"}, path: valid, expectedNets: 4},
+		{name: "hostname in entries", entries: []string{"relay.example.jp"}, expectedErr: "MyNetworks:"},
+		{name: "invalid line in file", path: invalid, expectedErr: invalid + ":2:"},
+		{name: "hostname in file", path: hostname, expectedErr: hostname + ":1:"},
+		{name: "missing file", path: filepath.Join(dir, "missing"), expectedErr: "MyNetworksFile:"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := parseCIDRs("MyNetworks", tc.entries, tc.path)
+			if tc.expectedErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedErr) {
+					t.Fatalf("expected error containing %q, got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n.ipNets.Len() != tc.expectedNets {
+				t.Errorf("expected %d networks, got %d", tc.expectedNets, n.ipNets.Len())
+			}
+		})
+	}
+}
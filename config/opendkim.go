@@ -0,0 +1,208 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// OpenDKIM 形式のテーブルファイルのプレフィックス
+const (
+	tableFilePrefix   = "file:"
+	tableRefilePrefix = "refile:"
+)
+
+// keyTableEntry は KeyTable の1エントリ (keyname domain:selector:keypath) を表す
+type keyTableEntry struct {
+	domain   string // d= ドメイン ("%" の場合はマッチしたドメインを使うため空)
+	selector string
+	keyFile  string
+}
+
+// readTableLines はテーブルファイルを読み込み、コメントと空行を除いた各行を
+// 行番号と空白区切りのフィールドとしてコールバックに渡す
+func readTableLines(path string, fn func(line int, fields []string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := fn(line, fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseKeyTable は OpenDKIM の KeyTable を読み込む
+func parseKeyTable(path string) (map[string]keyTableEntry, error) {
+	path = strings.TrimPrefix(path, tableFilePrefix)
+	keys := make(map[string]keyTableEntry)
+	err := readTableLines(path, func(line int, fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: invalid KeyTable entry", path, line)
+		}
+		name := fields[0]
+		if _, ok := keys[name]; ok {
+			return fmt.Errorf("%s:%d: duplicate key name %q", path, line, name)
+		}
+		parts := strings.SplitN(fields[1], ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return fmt.Errorf("%s:%d: invalid key specification %q", path, line, fields[1])
+		}
+		domain := parts[0]
+		if domain == "%" {
+			domain = ""
+		}
+		keys[name] = keyTableEntry{
+			domain:   domain,
+			selector: parts[1],
+			keyFile:  parts[2],
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// signingTablePattern は SigningTable のパターンを Domains のパターンに変換する
+// "*@example.jp" や "@example.jp" は "example.jp" に
+// refile の場合は "*@*.example.jp" を "*.example.jp" に、"*" を "*" に変換する
+// 送信者アドレス単位での指定には対応していない
+func signingTablePattern(pattern string, refile bool) (string, error) {
+	if pattern == "*" || pattern == "*@*" {
+		if !refile {
+			return "", fmt.Errorf("wildcard %q requires refile:", pattern)
+		}
+		return "*", nil
+	}
+
+	domain := pattern
+	if i := strings.LastIndex(pattern, "@"); i >= 0 {
+		local := pattern[:i]
+		if local != "" && local != "*" {
+			return "", fmt.Errorf("per-address pattern %q is not supported", pattern)
+		}
+		if local == "*" && !refile {
+			return "", fmt.Errorf("wildcard %q requires refile:", pattern)
+		}
+		domain = pattern[i+1:]
+	}
+	if domain == "" {
+		return "", fmt.Errorf("invalid pattern %q", pattern)
+	}
+
+	if !strings.Contains(domain, "*") {
+		return domain, nil
+	}
+	if !refile {
+		return "", fmt.Errorf("wildcard %q requires refile:", pattern)
+	}
+	// Domains のワイルドカードは "*.example.jp" 形式のみ
+	// (example.jp 自体にもマッチする点は OpenDKIM と異なる)
+	if !strings.HasPrefix(domain, "*.") || strings.Contains(domain[2:], "*") {
+		return "", fmt.Errorf("unsupported wildcard pattern %q", pattern)
+	}
+	return domain, nil
+}
+
+// parseSigningTable は OpenDKIM の SigningTable を読み込み KeyTable と組み合わせてドメイン設定を生成する
+func parseSigningTable(path string, keys map[string]keyTableEntry) (map[string]Domain, error) {
+	refile := strings.HasPrefix(path, tableRefilePrefix)
+	path = strings.TrimPrefix(path, tableRefilePrefix)
+	path = strings.TrimPrefix(path, tableFilePrefix)
+
+	domains := make(map[string]Domain)
+	lines := make(map[string]int)
+	err := readTableLines(path, func(line int, fields []string) error {
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: invalid SigningTable entry", path, line)
+		}
+		pattern, err := signingTablePattern(fields[0], refile)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if prev, ok := lines[pattern]; ok {
+			return fmt.Errorf("%s:%d: domain pattern %q is already defined at line %d", path, line, pattern, prev)
+		}
+		key, ok := keys[fields[1]]
+		if !ok {
+			return fmt.Errorf("%s:%d: key name %q is not found in KeyTable", path, line, fields[1])
+		}
+		lines[pattern] = line
+		domains[pattern] = Domain{
+			Selector:       key.selector,
+			PrivateKeyFile: key.keyFile,
+			SigningDomain:  key.domain,
+			DKIM:           true,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// loadOpenDKIMTables は KeyTable と SigningTable からドメイン設定を読み込み Domains に統合する
+func loadOpenDKIMTables(config *Config, sources map[string]string) error {
+	if config.KeyTable == "" && config.SigningTable == "" {
+		return nil
+	}
+	if config.KeyTable == "" {
+		return &ConfigError{Field: "KeyTable", Message: "is not set"}
+	}
+	if config.SigningTable == "" {
+		return &ConfigError{Field: "SigningTable", Message: "is not set"}
+	}
+
+	keys, err := parseKeyTable(config.KeyTable)
+	if err != nil {
+		return &ConfigError{Field: "KeyTable", Message: err.Error()}
+	}
+	domains, err := parseSigningTable(config.SigningTable, keys)
+	if err != nil {
+		return &ConfigError{Field: "SigningTable", Message: err.Error()}
+	}
+
+	return mergeDomains(config.Domains, sources, domains, "SigningTable")
+}
+
+// mergeDomains は他の定義元から読み込んだドメイン設定を Domains に統合する
+// 同じパターンが既に定義されている場合は両方の定義元を含むエラーを返す
+func mergeDomains(domains map[string]Domain, sources map[string]string, add map[string]Domain, source string) error {
+	patterns := make([]string, 0, len(add))
+	for pattern := range add {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if prev, ok := sources[pattern]; ok {
+			return &ConfigError{Field: source, Message: fmt.Sprintf(`domain pattern "%s" is already defined in %s`, pattern, prev)}
+		}
+		value := add[pattern]
+		value.Domain = pattern
+		value.Pattern = pattern
+		domains[pattern] = value
+		sources[pattern] = source
+	}
+	return nil
+}
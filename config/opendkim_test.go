@@ -0,0 +1,158 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_signingTablePattern(t *testing.T) {
+	testCases := []struct {
+		name      string
+		pattern   string
+		refile    bool
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "domain",
+			pattern:  "example.jp",
+			expected: "example.jp",
+		},
+		{
+			name:     "at domain",
+			pattern:  "@example.jp",
+			expected: "example.jp",
+		},
+		{
+			name:     "wildcard local part",
+			pattern:  "*@example.jp",
+			refile:   true,
+			expected: "example.jp",
+		},
+		{
+			name:      "wildcard local part without refile",
+			pattern:   "*@example.jp",
+			expectErr: true,
+		},
+		{
+			name:     "wildcard subdomain",
+			pattern:  "*@*.example.jp",
+			refile:   true,
+			expected: "*.example.jp",
+		},
+		{
+			name:     "default",
+			pattern:  "*",
+			refile:   true,
+			expected: "*",
+		},
+		{
+			name:      "per-address",
+			pattern:   "user@example.jp",
+			refile:    true,
+			expectErr: true,
+		},
+		{
+			name:      "unsupported wildcard",
+			pattern:   "*@mail*.example.jp",
+			refile:    true,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := signingTablePattern(tc.pattern, tc.refile)
+			if tc.expectErr {
+				if err == nil {
+					t.Errorf("expected error, but got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected: %s, but got: %s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_loadOpenDKIMTables(t *testing.T) {
+	dir := t.TempDir()
+	keyTable := filepath.Join(dir, "KeyTable")
+	signingTable := filepath.Join(dir, "SigningTable")
+	if err := os.WriteFile(keyTable, []byte(
+		"# comment\n"+
+			"example   %:default:/etc/opendkim/keys/example.key\n"+
+			"customer  provider.jp:customer:/etc/opendkim/keys/customer.key\n",
+	), 0600); err != nil {
+		t.Fatalf("failed to write KeyTable: %v", err)
+	}
+	if err := os.WriteFile(signingTable, []byte(
+		"*@example.jp      example\n"+
+			"*@*.customer.jp  customer # trailing comment\n",
+	), 0600); err != nil {
+		t.Fatalf("failed to write SigningTable: %v", err)
+	}
+
+	config := &Config{
+		Domains: map[string]Domain{
+			"inline.jp": {Selector: "inline"},
+		},
+		KeyTable:     keyTable,
+		SigningTable: "refile:" + signingTable,
+	}
+	sources := map[string]string{"inline.jp": "Domains"}
+	if err := loadOpenDKIMTables(config, sources); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(config.Domains) != 3 {
+		t.Fatalf("expected 3 domains, got %d", len(config.Domains))
+	}
+	d, ok := config.GetMatchingDomain("example.jp")
+	if !ok {
+		t.Fatalf("expected match for example.jp")
+	}
+	if d.Selector != "default" || d.Domain != "example.jp" || !d.DKIM {
+		t.Errorf("unexpected domain: %+v", d)
+	}
+	d, ok = config.GetMatchingDomain("mail.customer.jp")
+	if !ok {
+		t.Fatalf("expected match for mail.customer.jp")
+	}
+	if d.Selector != "customer" || d.Domain != "provider.jp" {
+		t.Errorf("unexpected domain: %+v", d)
+	}
+
+	t.Run("duplicate with inline Domains", func(t *testing.T) {
+		config := &Config{
+			Domains: map[string]Domain{
+				"example.jp": {Selector: "inline"},
+			},
+			KeyTable:     keyTable,
+			SigningTable: "refile:" + signingTable,
+		}
+		sources := map[string]string{"example.jp": "Domains"}
+		if err := loadOpenDKIMTables(config, sources); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+
+	t.Run("unknown key name", func(t *testing.T) {
+		if err := os.WriteFile(signingTable, []byte("example.jp unknown\n"), 0600); err != nil {
+			t.Fatalf("failed to write SigningTable: %v", err)
+		}
+		config := &Config{
+			Domains:      map[string]Domain{},
+			KeyTable:     keyTable,
+			SigningTable: signingTable,
+		}
+		if err := loadOpenDKIMTables(config, map[string]string{}); err == nil {
+			t.Errorf("expected error, but got nil")
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"net"
+)
+
+// prefixTree は IP アドレスの範囲を1ビットずつ分岐する木で保持し、
+// アドレスを含む範囲があるかをアドレス長に比例する時間で判定する
+// net.IPNet.Contains と同じく IPv4 と IPv6 の範囲は別の木で扱い、IPv4-mapped IPv6 アドレスは IPv4 の範囲とのみ比較する
+type prefixTree struct {
+	v4 prefixNode
+	v6 prefixNode
+	// 登録した範囲の数
+	size int
+}
+
+type prefixNode struct {
+	children [2]*prefixNode
+	// このノードまでのビット列が登録した範囲のプレフィックスと一致する
+	terminal bool
+}
+
+// normalizePrefix は ipNet をアドレスの種類に応じた長さのアドレスとプレフィックス長に正規化する
+func normalizePrefix(ipNet *net.IPNet) (net.IP, int, bool) {
+	ones, bits := ipNet.Mask.Size()
+	var ip net.IP
+	switch bits {
+	case 8 * net.IPv4len:
+		ip = ipNet.IP.To4()
+	case 8 * net.IPv6len:
+		// ::ffff:192.0.2.0/120 のような IPv4-mapped IPv6 の範囲は net.IPNet.Contains と同じく IPv4 の範囲として扱う
+		if ip = ipNet.IP.To4(); ip != nil {
+			ones = max(ones-8*(net.IPv6len-net.IPv4len), 0)
+		} else {
+			ip = ipNet.IP.To16()
+		}
+	}
+	if ip == nil {
+		return nil, 0, false
+	}
+	return ip, ones, true
+}
+
+// bitAt は ip の先頭から i ビット目を返す
+func bitAt(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+// rootFor は ip の長さに対応する木の根を返す
+func (t *prefixTree) rootFor(ip net.IP) *prefixNode {
+	if len(ip) == net.IPv4len {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// Insert は ipNet を登録する
+func (t *prefixTree) Insert(ipNet *net.IPNet) {
+	ip, ones, ok := normalizePrefix(ipNet)
+	if !ok {
+		return
+	}
+	node := t.rootFor(ip)
+	for i := 0; i < ones; i++ {
+		b := bitAt(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &prefixNode{}
+		}
+		node = node.children[b]
+	}
+	if !node.terminal {
+		node.terminal = true
+		t.size++
+	}
+}
+
+// Contains は ip を含む範囲が登録されているかを返す
+func (t *prefixTree) Contains(ip net.IP) bool {
+	if t.size == 0 {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if ip = ip.To16(); ip == nil {
+		return false
+	}
+	node := t.rootFor(ip)
+	for i := 0; i < 8*len(ip); i++ {
+		if node.terminal {
+			return true
+		}
+		node = node.children[bitAt(ip, i)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.terminal
+}
+
+// Len は登録した範囲の数を返す
+func (t *prefixTree) Len() int {
+	return t.size
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func Test_prefixTree(t *testing.T) {
+	var tree prefixTree
+	for _, cidr := range []string{"192.0.2.0/24", "198.51.100.128/25", "2001:db8::/32", "2001:db8:1::1/128", "192.0.2.0/24"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("failed to parse CIDR: %v", err)
+		}
+		tree.Insert(ipNet)
+	}
+	if tree.Len() != 4 {
+		t.Errorf("expected 4 prefixes, got %d", tree.Len())
+	}
+
+	testCases := []struct {
+		name     string
+		ip       string
+		expected bool
+	}{
+		{name: "IPv4 in /24", ip: "192.0.2.255", expected: true},
+		{name: "IPv4 out of /24", ip: "192.0.3.0", expected: false},
+		{name: "IPv4 in /25", ip: "198.51.100.200", expected: true},
+		{name: "IPv4 out of /25", ip: "198.51.100.127", expected: false},
+		{name: "IPv4-mapped IPv6", ip: "::ffff:192.0.2.1", expected: true},
+		{name: "IPv6 in /32", ip: "2001:db8:ffff::1", expected: true},
+		{name: "IPv6 out of /32", ip: "2001:db9::1", expected: false},
+		{name: "IPv6 /128", ip: "2001:db8:1::1", expected: true},
+		{name: "IPv4 compatible IPv6 is not IPv4", ip: "::c000:201", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tree.Contains(net.ParseIP(tc.ip)); got != tc.expected {
+				t.Errorf("expected %t, got %t", tc.expected, got)
+			}
+		})
+	}
+
+	var empty prefixTree
+	if empty.Contains(net.ParseIP("192.0.2.1")) {
+		t.Errorf("empty tree must not contain any address")
+	}
+	if tree.Contains(nil) {
+		t.Errorf("tree must not contain nil")
+	}
+
+	var all prefixTree
+	_, v4, _ := net.ParseCIDR("0.0.0.0/0")
+	all.Insert(v4)
+	if !all.Contains(net.ParseIP("203.0.113.1")) || all.Contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("0.0.0.0/0 must contain only IPv4 addresses")
+	}
+}
+
+// Test_prefixTree_IPv4Client は IPv6 の範囲が IPv4 の接続元を net.IPNet.Contains と同じく含まないことを確認する
+func Test_prefixTree_IPv4Client(t *testing.T) {
+	testCases := []struct {
+		cidr string
+		ip   string
+	}{
+		{cidr: "::/0", ip: "192.0.2.1"},
+		{cidr: "::/0", ip: "::ffff:192.0.2.1"},
+		{cidr: "::/0", ip: "2001:db8::1"},
+		{cidr: "::/64", ip: "192.0.2.1"},
+		{cidr: "::ffff:0:0/96", ip: "192.0.2.1"},
+		{cidr: "::ffff:192.0.2.0/120", ip: "192.0.2.1"},
+		{cidr: "0.0.0.0/0", ip: "::ffff:192.0.2.1"},
+		{cidr: "0.0.0.0/0", ip: "::"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.cidr+" "+tc.ip, func(t *testing.T) {
+			_, ipNet, err := net.ParseCIDR(tc.cidr)
+			if err != nil {
+				t.Fatalf("failed to parse CIDR: %v", err)
+			}
+			var tree prefixTree
+			tree.Insert(ipNet)
+			ip := net.ParseIP(tc.ip)
+			if got, expected := tree.Contains(ip), ipNet.Contains(ip); got != expected {
+				t.Errorf("expected %t, got %t", expected, got)
+			}
+		})
+	}
+}
+
+// randomPrefixes は n 個の IPv4 と IPv6 の範囲を生成する
+func randomPrefixes(r *rand.Rand, n int) []*net.IPNet {
+	ipNets := make([]*net.IPNet, 0, n)
+	for i := 0; i < n; i++ {
+		bits := 8 * net.IPv4len
+		if i%4 == 0 {
+			bits = 8 * net.IPv6len
+		}
+		ip := make(net.IP, bits/8)
+		r.Read(ip)
+		mask := net.CIDRMask(8+r.Intn(bits-7), bits)
+		ipNets = append(ipNets, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	}
+	return ipNets
+}
+
+// randomIP は ipNets のいずれかに近い IP アドレスを生成する
+func randomIP(r *rand.Rand, ipNets []*net.IPNet) net.IP {
+	ip := append(net.IP(nil), ipNets[r.Intn(len(ipNets))].IP...)
+	ip[len(ip)-1-r.Intn(len(ip)/2)] ^= byte(r.Intn(256))
+	return ip
+}
+
+func Test_prefixTree_Linear(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	ipNets := randomPrefixes(r, 1000)
+	var tree prefixTree
+	for _, ipNet := range ipNets {
+		tree.Insert(ipNet)
+	}
+	for i := 0; i < 10000; i++ {
+		ip := randomIP(r, ipNets)
+		expected := false
+		for _, ipNet := range ipNets {
+			if ipNet.Contains(ip) {
+				expected = true
+				break
+			}
+		}
+		if got := tree.Contains(ip); got != expected {
+			t.Fatalf("%s: expected %t, got %t", ip, expected, got)
+		}
+	}
+}
+
+func BenchmarkPrefixTree_Contains(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	ipNets := randomPrefixes(r, 5000)
+	var tree prefixTree
+	for _, ipNet := range ipNets {
+		tree.Insert(ipNet)
+	}
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = randomIP(r, ipNets)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Contains(ips[i%len(ips)])
+	}
+}
+
+func BenchmarkLinear_Contains(b *testing.B) {
+	r := rand.New(rand.NewSource(1))
+	ipNets := randomPrefixes(r, 5000)
+	ips := make([]net.IP, 1024)
+	for i := range ips {
+		ips[i] = randomIP(r, ipNets)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ip := ips[i%len(ips)]
+		for _, ipNet := range ipNets {
+			if ipNet.Contains(ip) {
+				break
+			}
+		}
+	}
+}
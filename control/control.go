@@ -1,20 +1,70 @@
 package control
 
 import (
+	"errors"
 	"log"
 	"net"
 	"net/rpc"
+	"sync"
+	"time"
 )
 
 // Control はRPCのレシーバとして動作し、子プロセスが準備完了したことを通知するための機能を提供します
+// また、子プロセスに対してドメイン設定と鍵の再読み込みを指示する機能を提供します
 type Control struct {
-	childReady func(pid int)
+	childReady    func(pid int)
+	reload        func() error
+	childReloaded func(pid int, generation int, err string)
+	childFailed   func(pid int, reason string)
+	restarts      func() []RestartEvent
+	childRetiring func(pid int)
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	generation int
 }
 
 func New(childReady func(pid int)) *Control {
-	return &Control{
+	c := &Control{
 		childReady: childReady,
 	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// HandleReload は Reload が呼ばれた際に実行する hook 関数を設定します
+func (c *Control) HandleReload(fn func() error) {
+	c.reload = fn
+}
+
+// HandleChildReloaded は子プロセスが再読み込み結果を通知した際に実行する hook 関数を設定します
+func (c *Control) HandleChildReloaded(fn func(pid int, generation int, err string)) {
+	c.childReloaded = fn
+}
+
+// HandleChildFailed は子プロセスが準備に失敗したことを通知した際に実行する hook 関数を設定します
+func (c *Control) HandleChildFailed(fn func(pid int, reason string)) {
+	c.childFailed = fn
+}
+
+// HandleChildRetiring は子プロセスが自ら終了する前に通知した際に実行する hook 関数を設定します
+func (c *Control) HandleChildRetiring(fn func(pid int)) {
+	c.childRetiring = fn
+}
+
+// HandleRestartHistory は RestartHistory が呼ばれた際に子プロセスの再起動履歴を返す hook 関数を設定します
+func (c *Control) HandleRestartHistory(fn func() []RestartEvent) {
+	c.restarts = fn
+}
+
+// NotifyReload は WaitReload で待機している子プロセスに再読み込みを指示します
+// 新しい世代番号を返します
+func (c *Control) NotifyReload() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.cond.Broadcast()
+	return c.generation
 }
 
 func (c *Control) Serve(l net.Listener) error {
@@ -42,3 +92,107 @@ func (c *Control) ChildReady(args ChildReadyArgs, reply *struct{}) error {
 	c.childReady(args.Pid)
 	return nil
 }
+
+// ChildFailedArgs は子プロセスが準備に失敗したことを通知するための引数を表します
+type ChildFailedArgs struct {
+	Pid    int
+	Reason string
+}
+
+// ChildFailed は子プロセスが待ち受けの開始やセルフチェックに失敗したことを通知するためのメソッドです
+// 事前に指定したhook関数を実行します
+func (c *Control) ChildFailed(args ChildFailedArgs, reply *struct{}) error {
+	if c.childFailed != nil {
+		c.childFailed(args.Pid, args.Reason)
+	}
+	return nil
+}
+
+// ChildRetiringArgs は子プロセスが自ら終了することを通知するための引数を表します
+type ChildRetiringArgs struct {
+	Pid int
+}
+
+// ChildRetiring は子プロセスが MaxSessionsPerChild に達して終了する前に通知するためのメソッドです
+// 事前に指定したhook関数を実行し、親プロセスは代わりの子プロセスを起動します
+func (c *Control) ChildRetiring(args ChildRetiringArgs, reply *struct{}) error {
+	if c.childRetiring != nil {
+		c.childRetiring(args.Pid)
+	}
+	return nil
+}
+
+// Reload はドメイン設定と鍵の再読み込みを要求するためのメソッドです
+// 事前に指定したhook関数を実行し、その結果を返します
+func (c *Control) Reload(args struct{}, reply *struct{}) error {
+	if c.reload == nil {
+		return errors.New("reload is not supported")
+	}
+	return c.reload()
+}
+
+// WaitReloadArgs は再読み込みの指示を待機するための引数を表します
+// Generation が負の場合は待機せずに現在の世代番号を返します
+type WaitReloadArgs struct {
+	Pid        int
+	Generation int
+}
+
+// WaitReloadReply は再読み込みを行うべき世代番号を表します
+type WaitReloadReply struct {
+	Generation int
+}
+
+// WaitReload は世代番号が args.Generation より新しくなるまで待機するメソッドです
+func (c *Control) WaitReload(args WaitReloadArgs, reply *WaitReloadReply) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for args.Generation >= 0 && c.generation <= args.Generation {
+		c.cond.Wait()
+	}
+	reply.Generation = c.generation
+	return nil
+}
+
+// ChildReloadedArgs は子プロセスの再読み込み結果を通知するための引数を表します
+// 成功した場合 Error は空文字列です
+type ChildReloadedArgs struct {
+	Pid        int
+	Generation int
+	Error      string
+}
+
+// ChildReloaded は子プロセスが再読み込みを終えたことを通知するためのメソッドです
+// 事前に指定したhook関数を実行します
+func (c *Control) ChildReloaded(args ChildReloadedArgs, reply *struct{}) error {
+	if c.childReloaded != nil {
+		c.childReloaded(args.Pid, args.Generation, args.Error)
+	}
+	return nil
+}
+
+// RestartEvent は子プロセスの異常終了と、それに対する再起動の判断を表します
+type RestartEvent struct {
+	Time  time.Time
+	Pid   int
+	Error string
+	// 再起動までの待ち時間
+	Backoff time.Duration
+	// 再起動を諦めた場合は true
+	GaveUp bool
+}
+
+// RestartHistoryReply は子プロセスの再起動履歴を古い順に表します
+type RestartHistoryReply struct {
+	Events []RestartEvent
+}
+
+// RestartHistory は子プロセスの再起動履歴を返すためのメソッドです
+// 事前に指定したhook関数を実行します
+func (c *Control) RestartHistory(args struct{}, reply *RestartHistoryReply) error {
+	if c.restarts == nil {
+		return errors.New("restart history is not supported")
+	}
+	reply.Events = c.restarts()
+	return nil
+}
@@ -0,0 +1,39 @@
+package control
+
+import (
+	"io"
+	"log"
+	"net/rpc"
+)
+
+// Keys はRPCのレシーバとして動作し、親プロセスが読み込んだ秘密鍵を子プロセスに渡す機能を提供します
+// 権限を変更した子プロセスは秘密鍵を読めない場合があるため、再読み込みの際はこの秘密鍵を使用します
+// control ソケットとは別に、子プロセスごとの接続でのみ提供します
+type Keys struct {
+	keys func() map[string][]byte
+}
+
+func NewKeys(keys func() map[string][]byte) *Keys {
+	return &Keys{keys: keys}
+}
+
+// KeysReply は秘密鍵ファイルの内容を PrivateKeyFile ごとに表します
+type KeysReply struct {
+	Keys map[string][]byte
+}
+
+// Get は親プロセスが読み込んだ秘密鍵を返すためのメソッドです
+func (k *Keys) Get(args struct{}, reply *KeysReply) error {
+	reply.Keys = k.keys()
+	return nil
+}
+
+// ServeConn は conn で Keys を提供します
+// conn が閉じられるまで処理を続けます
+func (k *Keys) ServeConn(conn io.ReadWriteCloser) {
+	server := rpc.NewServer()
+	if err := server.Register(k); err != nil {
+		log.Fatalf("failed to register keys: %v", err)
+	}
+	server.ServeConn(conn)
+}
@@ -4,6 +4,8 @@ go 1.24.0
 
 require (
 	github.com/d--j/go-milter v0.8.4
+	github.com/emersion/go-sasl v0.0.0-20241020182733-b788ff22d5a6
+	github.com/emersion/go-smtp v0.24.0
 	github.com/k0kubun/pp/v3 v3.2.0
 	github.com/masa23/mmauth v1.0.10
 	gopkg.in/yaml.v3 v3.0.1
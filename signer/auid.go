@@ -0,0 +1,67 @@
+package signer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+// buildAUID は設定に従って DKIM 署名の i= を生成する
+// d は署名ドメイン、from はヘッダ From のアドレス、authn は SMTP 認証ユーザ名
+// テンプレートの {subdomain} は From のドメインのうち d= より左側の部分に置き換える
+// auth で SMTP 認証されていない場合は i= を付与しないため空文字列を返す
+func buildAUID(setting, d, from, authn string) (string, error) {
+	var auid string
+	switch setting {
+	case config.AUIDFrom:
+		auid = from
+	case config.AUIDAuth:
+		if authn == "" {
+			return "", nil
+		}
+		auid = authn
+		if !strings.Contains(auid, "@") {
+			auid += "@" + d
+		}
+	default:
+		var local, domain, subdomain string
+		if i := strings.LastIndex(from, "@"); i >= 0 {
+			local, domain = from[:i], from[i+1:]
+		}
+		if suffix := "." + d; len(domain) > len(suffix) && strings.EqualFold(domain[len(domain)-len(suffix):], suffix) {
+			subdomain = domain[:len(domain)-len(suffix)]
+		}
+		auid = strings.NewReplacer(
+			"{local}", local,
+			"{domain}", domain,
+			"{subdomain}", subdomain,
+			"{auth}", authn,
+		).Replace(setting)
+	}
+
+	if err := checkAUID(auid, d); err != nil {
+		return "", err
+	}
+	return auid, nil
+}
+
+// checkAUID は i= のドメインが d= と同じかそのサブドメインであるかを確認する
+func checkAUID(auid, d string) error {
+	if strings.ContainsAny(auid, "; \t\r\n") {
+		return fmt.Errorf("invalid i= %q", auid)
+	}
+	i := strings.LastIndex(auid, "@")
+	if i < 0 {
+		return fmt.Errorf("invalid i= %q", auid)
+	}
+	domain := strings.ToLower(auid[i+1:])
+	d = strings.ToLower(d)
+	if strings.HasPrefix(domain, ".") || strings.Contains(domain, "..") {
+		return fmt.Errorf("invalid i= %q", auid)
+	}
+	if domain != d && !strings.HasSuffix(domain, "."+d) {
+		return fmt.Errorf("i= %q is not in the d= domain %s", auid, d)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package signer
+
+import "testing"
+
+func Test_buildAUID(t *testing.T) {
+	testCases := []struct {
+		name      string
+		setting   string
+		d         string
+		from      string
+		authn     string
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:     "from",
+			setting:  "from",
+			d:        "example.jp",
+			from:     "user@example.jp",
+			expected: "user@example.jp",
+		},
+		{
+			name:     "from subdomain",
+			setting:  "from",
+			d:        "example.jp",
+			from:     "user@Sales.Example.JP",
+			expected: "user@Sales.Example.JP",
+		},
+		{
+			name:      "from other domain",
+			setting:   "from",
+			d:         "example.jp",
+			from:      "user@example.org",
+			expectErr: true,
+		},
+		{
+			name:      "from similar domain",
+			setting:   "from",
+			d:         "example.jp",
+			from:      "user@badexample.jp",
+			expectErr: true,
+		},
+		{
+			name:     "auth",
+			setting:  "auth",
+			d:        "example.jp",
+			authn:    "login-user",
+			expected: "login-user@example.jp",
+		},
+		{
+			name:     "auth with domain",
+			setting:  "auth",
+			d:        "example.jp",
+			authn:    "login-user@mail.example.jp",
+			expected: "login-user@mail.example.jp",
+		},
+		{
+			name:     "auth without authentication",
+			setting:  "auth",
+			d:        "example.jp",
+			expected: "",
+		},
+		{
+			name:     "template subdomain",
+			setting:  "@{subdomain}.example.jp",
+			d:        "example.jp",
+			from:     "user@sales.example.jp",
+			expected: "@sales.example.jp",
+		},
+		{
+			name:      "template empty subdomain",
+			setting:   "@{subdomain}.example.jp",
+			d:         "example.jp",
+			from:      "user@example.jp",
+			expectErr: true,
+		},
+		{
+			name:     "template auth",
+			setting:  "{auth}@{domain}",
+			d:        "example.jp",
+			from:     "user@example.jp",
+			authn:    "login-user",
+			expected: "login-user@example.jp",
+		},
+		{
+			name:      "template invalid local part",
+			setting:   "{auth}@example.jp",
+			d:         "example.jp",
+			authn:     "login; x=1",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, err := buildAUID(tc.setting, tc.d, tc.from, tc.authn)
+			if err != nil && !tc.expectErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && tc.expectErr {
+				t.Errorf("expected error, but got %q", actual)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package signer
+
+// bodyLengthCounter は正規化後の本文の長さを数える
+// 本文全体を保持せず、行単位で mmauth の本文正規化と同じ長さを求める
+type bodyLengthCounter struct {
+	relaxed bool
+	line    []byte // 改行までの未処理の行
+	length  int64  // 確定した長さ
+	empty   int64  // 確定した長さに含めていない末尾の空行の数
+}
+
+func newBodyLengthCounter(canonicalization string) *bodyLengthCounter {
+	return &bodyLengthCounter{relaxed: canonicalization == "relaxed"}
+}
+
+func (c *bodyLengthCounter) Write(p []byte) (int, error) {
+	for _, ch := range p {
+		if ch != '\n' {
+			c.line = append(c.line, ch)
+			continue
+		}
+		line := c.line
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		c.addLine(c.lineLength(line))
+		c.line = c.line[:0]
+	}
+	return len(p), nil
+}
+
+// lineLength は改行を除いた行の正規化後の長さを返す
+func (c *bodyLengthCounter) lineLength(line []byte) int64 {
+	if !c.relaxed {
+		return int64(len(line))
+	}
+	// relaxed は行末の空白を取り除き、連続する空白を1つのスペースにする
+	var n int64
+	wsp := false
+	for _, ch := range line {
+		if ch == ' ' || ch == '\t' {
+			wsp = true
+			continue
+		}
+		if wsp {
+			n++
+		}
+		wsp = false
+		n++
+	}
+	return n
+}
+
+// addLine は行を加える
+// 空行は後に空でない行が続いた場合のみ長さに含める
+func (c *bodyLengthCounter) addLine(n int64) {
+	if n == 0 {
+		c.empty++
+		return
+	}
+	c.length += c.empty*2 + n + 2
+	c.empty = 0
+}
+
+// Length は正規化後の本文の長さを返す
+func (c *bodyLengthCounter) Length() int64 {
+	length := c.length
+	if n := c.lineLength(c.line); n > 0 {
+		// 改行で終わらない最後の行には CRLF が付加される
+		length += c.empty*2 + n + 2
+	}
+	if length == 0 && !c.relaxed {
+		// simple の空の本文は CRLF のみ
+		return 2
+	}
+	return length
+}
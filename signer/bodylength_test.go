@@ -0,0 +1,107 @@
+package signer
+
+import (
+	"crypto"
+	"testing"
+
+	"github.com/masa23/mmauth"
+)
+
+func Test_bodyLengthCounter(t *testing.T) {
+	testCases := []struct {
+		name             string
+		body             string
+		canonicalization string
+		expected         int64
+	}{
+		{
+			name:             "simple",
+			body:             "test\r\n",
+			canonicalization: "simple",
+			expected:         6,
+		},
+		{
+			name:             "simple trailing empty lines",
+			body:             "test  \r\n\r\nline\r\n\r\n\r\n",
+			canonicalization: "simple",
+			expected:         16,
+		},
+		{
+			name:             "simple without CRLF",
+			body:             "test\r\nline",
+			canonicalization: "simple",
+			expected:         12,
+		},
+		{
+			name:             "simple bare LF",
+			body:             "test\nline\n",
+			canonicalization: "simple",
+			expected:         12,
+		},
+		{
+			name:             "simple empty",
+			body:             "",
+			canonicalization: "simple",
+			expected:         2,
+		},
+		{
+			name:             "relaxed",
+			body:             "test\r\n",
+			canonicalization: "relaxed",
+			expected:         6,
+		},
+		{
+			name:             "relaxed whitespace",
+			body:             "  a \t b  \r\n \t\r\n\r\nc\t\r\n \r\n",
+			canonicalization: "relaxed",
+			expected:         13,
+		},
+		{
+			name:             "relaxed without CRLF",
+			body:             "test\r\nline  ",
+			canonicalization: "relaxed",
+			expected:         12,
+		},
+		{
+			name:             "relaxed empty",
+			body:             "\r\n\r\n",
+			canonicalization: "relaxed",
+			expected:         0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// チャンクの区切りに依存しないことを確認するため1バイトずつ書き込む
+			c := newBodyLengthCounter(tc.canonicalization)
+			for i := 0; i < len(tc.body); i++ {
+				c.Write([]byte{tc.body[i]})
+			}
+			length := c.Length()
+			if length != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, length)
+			}
+
+			// mmauth で l= を指定した BodyHash が本文全体と一致することを確認する
+			m := mmauth.NewMMAuth()
+			full := createBodyHashConfig(tc.canonicalization, crypto.SHA256, 0)
+			limited := createBodyHashConfig(tc.canonicalization, crypto.SHA256, length)
+			shorter := createBodyHashConfig(tc.canonicalization, crypto.SHA256, length-1)
+			m.AddBodyHash(full)
+			m.AddBodyHash(limited)
+			m.AddBodyHash(shorter)
+			if _, err := m.Write([]byte("From: test@example.jp\r\n\r\n" + tc.body)); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+			if err := m.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+			if m.GetBodyHash(limited) != m.GetBodyHash(full) {
+				t.Errorf("body hash with l=%d does not match the whole body", length)
+			}
+			if length > 1 && m.GetBodyHash(shorter) == m.GetBodyHash(full) {
+				t.Errorf("body hash with l=%d matches the whole body", length-1)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package signer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+// messageChunkSize は SignMessage と VerifyMessage で本文を Write に渡す大きさ
+// milter で MTA から渡される本文の最大の大きさに合わせる
+const messageChunkSize = 65535
+
+// headerField はメッセージのヘッダ
+// raw は折り返しと末尾の CRLF を含む元のヘッダ
+type headerField struct {
+	name  string
+	value string
+	raw   string
+}
+
+// SignMessage は r から読み込んだメッセージに milter のセッションと同じ処理で DKIM と ARC の署名を行い w に出力する
+// listen の処理方針と署名ドメインの決定方法を使用し、改行が LF のみの場合は LF のまま出力する
+// 追加したヘッダの数を返す
+func SignMessage(r io.Reader, w io.Writer, conf *config.Config, listen *config.MilterListen, env Envelope) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read message: %v", err)
+	}
+	crlf := bytes.Contains(data, []byte("\r\n"))
+	fields, body := splitMessage(normalizeCRLF(data))
+
+	m := NewMessage(conf, listen, env)
+	m.writeMessage(fields, body)
+	headers, err := m.Sign()
+	if err != nil {
+		return 0, err
+	}
+
+	var buf bytes.Buffer
+	for _, h := range headers {
+		buf.WriteString(h.Name + ": " + h.Value + "\r\n")
+	}
+	for _, f := range fields {
+		buf.WriteString(f.raw)
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	out := buf.Bytes()
+	if !crlf {
+		out = bytes.ReplaceAll(out, []byte("\r\n"), []byte("\n"))
+	}
+	if _, err := w.Write(out); err != nil {
+		return 0, fmt.Errorf("failed to write message: %v", err)
+	}
+	return len(headers), nil
+}
+
+// writeMessage はヘッダと本文を milter で MTA から受け取る場合と同じ順に渡す
+func (m *Message) writeMessage(fields []headerField, body []byte) {
+	for _, f := range fields {
+		m.AddHeader(f.name, f.value)
+	}
+	m.EndHeaders()
+	for len(body) > 0 {
+		n := min(len(body), messageChunkSize)
+		m.Write(body[:n])
+		body = body[n:]
+	}
+}
+
+// normalizeCRLF は CR を伴わない LF を CRLF に変換する
+func normalizeCRLF(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			buf.WriteByte('\r')
+		}
+		buf.WriteByte(c)
+	}
+	return buf.Bytes()
+}
+
+// splitMessage はメッセージをヘッダと本文に分割する
+// ヘッダの値は milter で MTA から渡される形と同じく、区切りの ':' の後の空白を1つ取り除き、折り返しはそのまま残す
+func splitMessage(data []byte) ([]headerField, []byte) {
+	var fields []headerField
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.Index(rest, []byte("\r\n"))
+		if end < 0 {
+			end = len(rest)
+		}
+		line := string(rest[:end])
+		rest = rest[min(end+2, len(rest)):]
+		if line == "" {
+			// ヘッダと本文の区切り
+			return fields, rest
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			f := &fields[len(fields)-1]
+			f.value += "\r\n" + line
+			f.raw += line + "\r\n"
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			// ヘッダの形式でない行以降は本文として扱う
+			return fields, append([]byte(line+"\r\n"), rest...)
+		}
+		fields = append(fields, headerField{
+			name:  strings.TrimRight(name, " \t"),
+			value: strings.TrimPrefix(value, " "),
+			raw:   line + "\r\n",
+		})
+	}
+	return fields, nil
+}
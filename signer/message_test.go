@@ -0,0 +1,230 @@
+package signer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth/arc"
+	"github.com/masa23/mmauth/dkim"
+)
+
+func Test_SignMessage(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	resolver := mapResolver{
+		"default._domainkey.example.jp": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+	conf := &config.Config{
+		PartialBodyPolicy: config.PartialBodyPolicyAccept,
+		MilterListens: []config.MilterListen{
+			{SigningIdentities: []string{config.SigningIdentityFrom}, Policy: config.ListenPolicyBoth},
+		},
+		Domains: map[string]config.Domain{
+			"example.jp": {
+				HeaderCanonicalization: "relaxed",
+				BodyCanonicalization:   "relaxed",
+				HashAlgo:               crypto.SHA256,
+				Domain:                 "example.jp",
+				Selector:               "default",
+				ARCSelector:            "default",
+				PrivateKeySigner:       key,
+				DKIM:                   true,
+				ARC:                    true,
+				DKIMSignHeaders:        []string{"From", "To", "Subject"},
+				ARCSignHeaders:         []string{"From", "To", "Subject", "DKIM-Signature"},
+				ResignPolicy:           config.ResignPolicyAlways,
+			},
+		},
+	}
+	message := "From: test@example.jp\r\nTo: user@example.jp\r\nSubject: test\r\n\r\ntest message\r\n"
+
+	testCases := []struct {
+		name         string
+		message      string
+		env          Envelope
+		expectedDKIM bool
+		expectedARC  bool
+	}{
+		{
+			name:         "DKIM and ARC",
+			message:      message,
+			env:          Envelope{RemoteAddr: net.ParseIP("192.0.2.1"), Rcpts: []string{"user@example.jp"}},
+			expectedDKIM: true,
+			expectedARC:  true,
+		},
+		{
+			name:         "LF line endings",
+			message:      strings.ReplaceAll(message, "\r\n", "\n"),
+			env:          Envelope{RemoteAddr: net.ParseIP("192.0.2.1"), Rcpts: []string{"user@example.jp"}},
+			expectedDKIM: true,
+			expectedARC:  true,
+		},
+		{
+			name:         "authenticated",
+			message:      message,
+			env:          Envelope{RemoteAddr: net.ParseIP("192.0.2.1"), Rcpts: []string{"user@example.jp"}, AuthUser: "test"},
+			expectedDKIM: true,
+		},
+		{
+			name:    "not a signing domain",
+			message: strings.Replace(message, "test@example.jp", "test@example.com", 1),
+			env:     Envelope{RemoteAddr: net.ParseIP("192.0.2.1"), Rcpts: []string{"user@example.com"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			added, err := SignMessage(strings.NewReader(tc.message), &out, conf, &conf.MilterListens[0], tc.env)
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			expected := 0
+			if tc.expectedDKIM {
+				expected++
+			}
+			if tc.expectedARC {
+				expected += 3
+			}
+			if added != expected {
+				t.Errorf("expected %d headers added, got %d", expected, added)
+			}
+			// 元のメッセージは変更せずにヘッダを先頭に追加する
+			if !strings.HasSuffix(out.String(), tc.message) {
+				t.Errorf("original message is modified: %q", out.String())
+			}
+			if !strings.Contains(tc.message, "\r\n") && strings.Contains(out.String(), "\r") {
+				t.Errorf("line endings are changed: %q", out.String())
+			}
+
+			report, err := VerifyMessage(&out, VerifyOptions{Resolver: resolver})
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if tc.expectedDKIM {
+				if len(report.DKIM) != 1 || report.DKIM[0].VerifyResult.Status() != dkim.VerifyStatusPass {
+					t.Errorf("DKIM signature is not verified: %v", report.Results)
+				}
+			} else if len(report.DKIM) != 0 {
+				t.Errorf("unexpected DKIM signature: %v", report.Results)
+			}
+			if tc.expectedARC {
+				if len(report.ARC) != 1 || report.ARCChain != arc.ChainValidationResultPass {
+					t.Errorf("ARC chain is not verified: %v", report.Results)
+				}
+			} else if len(report.ARC) != 0 {
+				t.Errorf("unexpected ARC instance: %v", report.Results)
+			}
+		})
+	}
+
+}
+
+func Test_Message_Sign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	conf := &config.Config{
+		PartialBodyPolicy: config.PartialBodyPolicyAccept,
+		Domains: map[string]config.Domain{
+			"example.jp": {
+				HeaderCanonicalization: "relaxed",
+				BodyCanonicalization:   "relaxed",
+				HashAlgo:               crypto.SHA256,
+				Domain:                 "example.jp",
+				Selector:               "default",
+				ARCSelector:            "default",
+				PrivateKeySigner:       key,
+				DKIM:                   true,
+				ARC:                    true,
+				DKIMSignHeaders:        []string{"From", "To", "Subject"},
+				ARCSignHeaders:         []string{"From", "To", "Subject", "DKIM-Signature"},
+				ResignPolicy:           config.ResignPolicyAlways,
+			},
+		},
+	}
+	listen := &config.MilterListen{SigningIdentities: []string{config.SigningIdentityFrom}, Policy: config.ListenPolicyBoth}
+
+	m := NewMessage(conf, listen, Envelope{RemoteAddr: net.ParseIP("192.0.2.1"), Rcpts: []string{"user@example.jp"}})
+	m.SetResolver(mapResolver{})
+	m.AddHeader("From", "test@example.jp")
+	m.AddHeader("To", "user@example.jp")
+	m.AddHeader("Subject", "test")
+	m.EndHeaders()
+	if _, err := m.Write([]byte("test message\r\n")); err != nil {
+		t.Fatalf("failed to write body: %v", err)
+	}
+	headers, err := m.Sign()
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+
+	// 先頭に追加する順で返す
+	var names []string
+	for _, h := range headers {
+		names = append(names, h.Name)
+	}
+	expected := []string{"ARC-Seal", "ARC-Message-Signature", "ARC-Authentication-Results", "DKIM-Signature"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func Test_splitMessage(t *testing.T) {
+	testCases := []struct {
+		name           string
+		message        string
+		expectedFields []headerField
+		expectedBody   string
+	}{
+		{
+			name:    "folded header",
+			message: "From: test@example.jp\r\nSubject: folded\r\n subject\r\nX-Empty:\r\n\r\nbody\r\n",
+			expectedFields: []headerField{
+				{name: "From", value: "test@example.jp", raw: "From: test@example.jp\r\n"},
+				{name: "Subject", value: "folded\r\n subject", raw: "Subject: folded\r\n subject\r\n"},
+				{name: "X-Empty", value: "", raw: "X-Empty:\r\n"},
+			},
+			expectedBody: "body\r\n",
+		},
+		{
+			name:           "no body",
+			message:        "From: test@example.jp\r\n",
+			expectedFields: []headerField{{name: "From", value: "test@example.jp", raw: "From: test@example.jp\r\n"}},
+		},
+		{
+			name:           "not a header line",
+			message:        "From: test@example.jp\r\nbody\r\n",
+			expectedFields: []headerField{{name: "From", value: "test@example.jp", raw: "From: test@example.jp\r\n"}},
+			expectedBody:   "body\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fields, body := splitMessage([]byte(tc.message))
+			if !reflect.DeepEqual(fields, tc.expectedFields) {
+				t.Errorf("expected %+v, got %+v", tc.expectedFields, fields)
+			}
+			if string(body) != tc.expectedBody {
+				t.Errorf("expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
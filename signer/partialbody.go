@@ -0,0 +1,98 @@
+package signer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth"
+	"github.com/masa23/mmauth/dkim"
+)
+
+// fullBodyHashConfig は l= が指定された DKIM-Signature から本文全体の BodyHash の設定を返す
+// l= の BodyHash と比較して本文の一部のみが署名されているかを判定するために使用する
+func fullBodyHashConfig(header string) (mmauth.BodyCanonicalizationAndAlgorithm, bool) {
+	sig, err := dkim.ParseSignature(header)
+	if err != nil || sig.Limit <= 0 {
+		return mmauth.BodyCanonicalizationAndAlgorithm{}, false
+	}
+	can := sig.GetCanonicalizationAndAlgorithm()
+	if can == nil {
+		return mmauth.BodyCanonicalizationAndAlgorithm{}, false
+	}
+	return createBodyHashConfig(string(can.Body), can.HashAlgo, 0), true
+}
+
+// isPartialBody は検証に成功した DKIM 署名の l= が本文の一部しか含まないかを返す
+func isPartialBody(sig *dkim.Signature, m *mmauth.MMAuth) bool {
+	if sig.Limit <= 0 || sig.VerifyResult == nil || sig.VerifyResult.Status() != dkim.VerifyStatusPass {
+		return false
+	}
+	can := sig.GetCanonicalizationAndAlgorithm()
+	if can == nil {
+		return false
+	}
+	full := m.GetBodyHash(createBodyHashConfig(string(can.Body), can.HashAlgo, 0))
+	if full == "" {
+		// 本文全体の BodyHash を計算していない場合は判定できない
+		return false
+	}
+	return m.GetBodyHash(createBodyHashConfig(string(can.Body), can.HashAlgo, sig.Limit)) != full
+}
+
+// applyPartialBodyPolicy は認証結果のうち本文の一部のみを署名した DKIM の結果を policy に従って書き換える
+// results は GetAuthenticationHeader の戻り値で、dkim= の結果は header.d と header.s で DKIM 署名に対応付ける
+func applyPartialBodyPolicy(results []string, m *mmauth.MMAuth, policy string) []string {
+	if policy == config.PartialBodyPolicyAccept || m.AuthenticationHeaders == nil || m.AuthenticationHeaders.DKIMSignatures == nil {
+		return results
+	}
+
+	var sigs []*dkim.Signature
+	for _, sig := range *m.AuthenticationHeaders.DKIMSignatures {
+		if sig != nil {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	matched := make([]bool, len(sigs))
+	for n, result := range results {
+		if !strings.HasPrefix(result, "dkim=") {
+			continue
+		}
+		sig := matchDKIMResult(result, sigs, matched)
+		if sig == nil || !isPartialBody(sig, m) {
+			continue
+		}
+		comment := fmt.Sprintf(" (body length limit l=%d covers part of the body)", sig.Limit)
+		if policy == config.PartialBodyPolicyDowngrade {
+			result = "dkim=policy" + strings.TrimPrefix(result, "dkim=pass")
+		}
+		results[n] = result + comment
+	}
+	return results
+}
+
+// matchDKIMResult は dkim= の結果の header.d と header.s に一致する DKIM 署名を返す
+// 同じ d= と s= の署名が複数ある場合は、matched に記録したまだ対応付けていない署名を先頭から使用する
+func matchDKIMResult(result string, sigs []*dkim.Signature, matched []bool) *dkim.Signature {
+	// header.d= 以降はコメントの後に付加されるため、コメント内の文字列と誤認しないよう末尾から探す
+	i := strings.LastIndex(result, " header.d=")
+	if i < 0 {
+		return nil
+	}
+	var d, s string
+	for _, field := range strings.Fields(result[i:]) {
+		if v, ok := strings.CutPrefix(field, "header.d="); ok {
+			d = v
+		} else if v, ok := strings.CutPrefix(field, "header.s="); ok {
+			s = v
+		}
+	}
+	for j, sig := range sigs {
+		if !matched[j] && strings.EqualFold(sig.Domain, d) && strings.EqualFold(sig.Selector, s) {
+			matched[j] = true
+			return sig
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth"
+	"github.com/masa23/mmauth/dkim"
+	"github.com/masa23/mmauth/domainkey"
+)
+
+func Test_applyPartialBodyPolicy(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	domainKey, err := domainkey.ParseDomainKeyRecord("v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatalf("failed to parse domain key: %v", err)
+	}
+
+	headers := []string{
+		"From: test@example.jp\r\n",
+		"To: outside@example.com\r\n",
+	}
+	body := "test\r\n"
+	footer := "appended footer\r\n"
+
+	// 署名時の本文の長さを l= に記録して署名する
+	sign := func(limit int64) string {
+		m := mmauth.NewMMAuth()
+		m.AddBodyHash(createBodyHashConfig("relaxed", crypto.SHA256, 0))
+		if _, err := m.Write([]byte(strings.Join(headers, "") + "\r\n" + body)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		sig := dkim.Signature{
+			Algorithm:        dkim.SignatureAlgorithmRSA_SHA256,
+			BodyHash:         m.GetBodyHash(createBodyHashConfig("relaxed", crypto.SHA256, 0)),
+			Canonicalization: "relaxed/relaxed",
+			Domain:           "example.jp",
+			Selector:         "default",
+			Limit:            limit,
+			Version:          1,
+		}
+		if err := signDKIM(&sig, headers, []string{"From", "To"}, key); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+		return "DKIM-Signature: " + dkimHeaderValue(&sig) + "\r\n"
+	}
+
+	// 受信したメッセージを検証する
+	verify := func(signature string, body string) *mmauth.MMAuth {
+		m := mmauth.NewMMAuth()
+		if bca, ok := fullBodyHashConfig(signature); ok {
+			m.AddBodyHash(bca)
+		}
+		if _, err := m.Write([]byte(signature + strings.Join(headers, "") + "\r\n" + body)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		for _, sig := range *m.AuthenticationHeaders.DKIMSignatures {
+			can := sig.GetCanonicalizationAndAlgorithm()
+			bodyHash := m.GetBodyHash(createBodyHashConfig(string(can.Body), can.HashAlgo, sig.Limit))
+			sig.Verify(m.Headers, bodyHash, &domainKey)
+		}
+		return m
+	}
+
+	testCases := []struct {
+		name     string
+		limit    int64
+		body     string
+		policy   string
+		expected string
+		comment  bool
+	}{
+		{
+			name:     "accept",
+			limit:    int64(len(body)),
+			body:     body + footer,
+			policy:   config.PartialBodyPolicyAccept,
+			expected: "dkim=pass",
+		},
+		{
+			name:     "flag",
+			limit:    int64(len(body)),
+			body:     body + footer,
+			policy:   config.PartialBodyPolicyFlag,
+			expected: "dkim=pass",
+			comment:  true,
+		},
+		{
+			name:     "downgrade",
+			limit:    int64(len(body)),
+			body:     body + footer,
+			policy:   config.PartialBodyPolicyDowngrade,
+			expected: "dkim=policy",
+			comment:  true,
+		},
+		{
+			name:     "whole body with l=",
+			limit:    int64(len(body)),
+			body:     body,
+			policy:   config.PartialBodyPolicyDowngrade,
+			expected: "dkim=pass",
+		},
+		{
+			name:     "without l=",
+			body:     body,
+			policy:   config.PartialBodyPolicyDowngrade,
+			expected: "dkim=pass",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m := verify(sign(tc.limit), tc.body)
+			sig := (*m.AuthenticationHeaders.DKIMSignatures)[0]
+			results := []string{"spf=none", sig.ResultString(), "arc=none"}
+
+			results = applyPartialBodyPolicy(results, m, tc.policy)
+			if results[0] != "spf=none" || results[2] != "arc=none" {
+				t.Errorf("unexpected change in other results: %v", results)
+			}
+			if !strings.HasPrefix(results[1], tc.expected+" ") {
+				t.Errorf("expected %s, got %s", tc.expected, results[1])
+			}
+			if strings.Contains(results[1], "covers part of the body") != tc.comment {
+				t.Errorf("unexpected comment: %s", results[1])
+			}
+		})
+	}
+}
+
+func Test_matchDKIMResult(t *testing.T) {
+	sigs := []*dkim.Signature{
+		{Domain: "example.jp", Selector: "default"},
+		{Domain: "example.com", Selector: "s1"},
+		{Domain: "example.jp", Selector: "default"},
+	}
+
+	testCases := []struct {
+		name     string
+		results  []string
+		expected []int
+	}{
+		{
+			name:     "in order",
+			results:  []string{"dkim=pass (ok) header.d=example.jp header.s=default", "dkim=pass (ok) header.d=example.com header.s=s1"},
+			expected: []int{0, 1},
+		},
+		{
+			name:     "out of order",
+			results:  []string{"dkim=fail (bad) header.d=example.com header.s=s1", "dkim=pass (ok) header.d=example.jp header.s=default", "dkim=pass (ok) header.d=example.jp header.s=default"},
+			expected: []int{1, 0, 2},
+		},
+		{
+			name:     "case insensitive",
+			results:  []string{"dkim=pass (ok) header.d=EXAMPLE.COM header.s=S1 header.i=@example.com"},
+			expected: []int{1},
+		},
+		{
+			name:     "tags in comment",
+			results:  []string{"dkim=fail (header.d=example.jp header.s=default) header.d=example.com header.s=s1"},
+			expected: []int{1},
+		},
+		{
+			name:     "unknown signature",
+			results:  []string{"dkim=pass (ok) header.d=example.net header.s=default", "dkim=none"},
+			expected: []int{-1, -1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			matched := make([]bool, len(sigs))
+			for n, result := range tc.results {
+				sig := matchDKIMResult(result, sigs, matched)
+				got := -1
+				for i := range sigs {
+					if sigs[i] == sig {
+						got = i
+					}
+				}
+				if got != tc.expected[n] {
+					t.Errorf("%s: expected signature %d, got %d", result, tc.expected[n], got)
+				}
+			}
+		})
+	}
+}
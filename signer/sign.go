@@ -0,0 +1,217 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth"
+	"github.com/masa23/mmauth/dkim"
+)
+
+// clock は署名時刻の取得に使用する時計 (nil の場合は time.Now を使用する)
+var clock atomic.Pointer[func() time.Time]
+
+// SetClock は署名時刻の取得に使用する時計を差し替える
+// nil を指定すると time.Now に戻す
+func SetClock(fn func() time.Time) {
+	if fn == nil {
+		clock.Store(nil)
+		return
+	}
+	clock.Store(&fn)
+}
+
+// now は署名時刻を返す
+func now() time.Time {
+	if fn := clock.Load(); fn != nil {
+		return (*fn)()
+	}
+	return time.Now()
+}
+
+// setDKIMTimestamp はドメイン設定に従って DKIM 署名の t= と x= を設定する
+func setDKIMTimestamp(sig *dkim.Signature, domain *config.Domain) {
+	t := now()
+	sig.Timestamp = 0
+	if domain.IsSignatureTimestamp() {
+		sig.Timestamp = t.Unix()
+	}
+	sig.SignatureExpiration = 0
+	if domain.SignatureTTLDuration > 0 {
+		sig.SignatureExpiration = t.Add(domain.SignatureTTLDuration).Unix()
+	}
+}
+
+// dkimHeaderValue は DKIM-Signature ヘッダの値を返す
+// dkim.Signature.String は常に t= を出力するため、Timestamp が 0 の場合は取り除く
+func dkimHeaderValue(sig *dkim.Signature) string {
+	v := sig.String()
+	if sig.Timestamp == 0 {
+		v = strings.Replace(v, " t=0; v=", " v=", 1)
+	}
+	return v
+}
+
+// findResignConflict は policy に従って DKIM 署名を行わない理由となる既存の DKIM-Signature を探す
+// 見つかった場合はその署名の d= と s= を返す
+func findResignConflict(headers []string, policy, d, selector string) (string, bool) {
+	if policy == config.ResignPolicyAlways {
+		return "", false
+	}
+	for _, h := range headers {
+		k, _, ok := strings.Cut(h, ":")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "DKIM-Signature") {
+			continue
+		}
+		sig, err := dkim.ParseSignature(h)
+		if err != nil {
+			// 解析できない署名は any の場合のみ既存の署名として扱う
+			if policy == config.ResignPolicyAny {
+				return "unparsable signature", true
+			}
+			continue
+		}
+		found := fmt.Sprintf("d=%s s=%s", sig.Domain, sig.Selector)
+		switch policy {
+		case config.ResignPolicyAny:
+			return found, true
+		case config.ResignPolicySameDomain:
+			if strings.EqualFold(sig.Domain, d) {
+				return found, true
+			}
+		case config.ResignPolicySameSelector:
+			if strings.EqualFold(sig.Domain, d) && strings.EqualFold(sig.Selector, selector) {
+				return found, true
+			}
+		}
+	}
+	return "", false
+}
+
+// dkimHeaderNames は DKIM 署名の h= に並べるヘッダ名の一覧を返す
+// signHeaders は存在するヘッダのみを対象とし、oversignHeaders は出現回数より1回多く並べる
+// 余分に並べたヘッダは署名後に同名ヘッダが追加されると検証に失敗するため、ヘッダの追加攻撃を防ぐことができる
+func dkimHeaderNames(headers []string, signHeaders, oversignHeaders []string) []string {
+	count := make(map[string]int)
+	for _, h := range headers {
+		k, _, ok := strings.Cut(h, ":")
+		if !ok {
+			continue
+		}
+		count[strings.ToLower(strings.TrimSpace(k))]++
+	}
+
+	oversign := make(map[string]bool, len(oversignHeaders))
+	for _, h := range oversignHeaders {
+		oversign[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+
+	var names []string
+	done := make(map[string]bool)
+	appendOversign := func(name, key string) {
+		if done[key] {
+			return
+		}
+		done[key] = true
+		for i := 0; i < count[key]+1; i++ {
+			names = append(names, name)
+		}
+	}
+
+	remain := make(map[string]int, len(count))
+	for k, v := range count {
+		remain[k] = v
+	}
+	for _, h := range signHeaders {
+		name := strings.TrimSpace(h)
+		key := strings.ToLower(name)
+		if oversign[key] {
+			appendOversign(name, key)
+			continue
+		}
+		if remain[key] == 0 {
+			continue
+		}
+		remain[key]--
+		names = append(names, name)
+	}
+	for _, h := range oversignHeaders {
+		name := strings.TrimSpace(h)
+		appendOversign(name, strings.ToLower(name))
+	}
+
+	return names
+}
+
+// canonicalizeHeader は DKIM のヘッダ正規化を行う
+func canonicalizeHeader(header string, canonicalization string) string {
+	if canonicalization != "relaxed" {
+		return header
+	}
+	k, v, ok := strings.Cut(header, ":")
+	if !ok {
+		return strings.ToLower(strings.TrimSpace(header)) + ":\r\n"
+	}
+	k = strings.ToLower(strings.TrimSpace(k))
+	v = strings.ReplaceAll(v, "\r\n", "")
+	v = strings.Join(strings.FieldsFunc(v, func(r rune) bool {
+		return r == ' ' || r == '\t'
+	}), " ")
+	return k + ":" + strings.TrimSpace(v) + "\r\n"
+}
+
+// signDKIM は h= に names を並べて DKIM 署名を行う
+// dkim.Signature.Sign は存在するヘッダのみを h= に含めるため、オーバーサインに対応するよう署名値を計算する
+func signDKIM(sig *dkim.Signature, headers []string, names []string, key crypto.Signer) error {
+	if sig.Version != 1 {
+		return errors.New("dkim: invalid version")
+	}
+	canonHeader, _, _ := strings.Cut(sig.Canonicalization, "/")
+
+	sig.Headers = strings.Join(names, ":")
+	sig.Signature = ""
+
+	var sb strings.Builder
+	for _, h := range mmauth.ExtractHeadersDKIM(headers, names) {
+		sb.WriteString(canonicalizeHeader(h, canonHeader))
+	}
+	// DKIM-Signature 自身は b= を空にし、末尾の CRLF を除いて署名対象に含める
+	sb.WriteString(strings.TrimSuffix(canonicalizeHeader("DKIM-Signature: "+dkimHeaderValue(sig)+"\r\n", canonHeader), "\r\n"))
+
+	var digest []byte
+	hash := crypto.SHA256
+	if sig.Algorithm == dkim.SignatureAlgorithmRSA_SHA1 {
+		sum := sha1.Sum([]byte(sb.String()))
+		digest = sum[:]
+		hash = crypto.SHA1
+	} else {
+		sum := sha256.Sum256([]byte(sb.String()))
+		digest = sum[:]
+	}
+
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+	case ed25519.PublicKey:
+		hash = crypto.Hash(0)
+	default:
+		return fmt.Errorf("unknown key type: %T", key.Public())
+	}
+
+	b, err := key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return err
+	}
+	sig.Signature = base64.StdEncoding.EncodeToString(b)
+	return nil
+}
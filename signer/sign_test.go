@@ -0,0 +1,275 @@
+package signer
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth/dkim"
+	"github.com/masa23/mmauth/domainkey"
+)
+
+func Test_dkimHeaderNames(t *testing.T) {
+	headers := []string{
+		"From: test@example.jp\r\n",
+		"To: a@example.com\r\n",
+		"To: b@example.com\r\n",
+		"Subject: test\r\n",
+	}
+	testCases := []struct {
+		name     string
+		sign     []string
+		oversign []string
+		expected []string
+	}{
+		{
+			name:     "no oversign",
+			sign:     []string{"Date", "From", "To", "Subject"},
+			expected: []string{"From", "To", "Subject"},
+		},
+		{
+			name:     "oversign listed headers",
+			sign:     []string{"Date", "From", "To", "Subject"},
+			oversign: []string{"From", "To", "Subject", "Reply-To"},
+			expected: []string{"From", "From", "To", "To", "To", "Subject", "Subject", "Reply-To"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual := dkimHeaderNames(headers, tc.sign, tc.oversign)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func Test_signDKIM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	domainKey, err := domainkey.ParseDomainKeyRecord("v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub))
+	if err != nil {
+		t.Fatalf("failed to parse domain key: %v", err)
+	}
+
+	headers := []string{
+		"From: test@example.jp\r\n",
+		"To: outside@example.com\r\n",
+		"Subject:  folded\r\n subject\r\n",
+	}
+	bodyHash := "g3zLYH4xKxcPrHOD18z9YfpQcnk/GaJedfustWU5uGs="
+
+	for _, canon := range []string{"relaxed/relaxed", "simple/simple"} {
+		t.Run(canon, func(t *testing.T) {
+			sig := dkim.Signature{
+				Algorithm:        dkim.SignatureAlgorithmRSA_SHA256,
+				BodyHash:         bodyHash,
+				Canonicalization: canon,
+				Domain:           "example.jp",
+				Selector:         "default",
+				Version:          1,
+			}
+			names := dkimHeaderNames(headers, []string{"From", "To", "Subject"}, []string{"From", "Subject"})
+			if err := signDKIM(&sig, headers, names, key); err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			if sig.Headers != "From:From:To:Subject:Subject" {
+				t.Errorf("unexpected h=: %s", sig.Headers)
+			}
+
+			verify := func(headers []string) dkim.VerifyStatus {
+				parsed, err := dkim.ParseSignature("DKIM-Signature: " + dkimHeaderValue(&sig) + "\r\n")
+				if err != nil {
+					t.Fatalf("failed to parse signature: %v", err)
+				}
+				signed := append([]string{"DKIM-Signature: " + dkimHeaderValue(&sig) + "\r\n"}, headers...)
+				parsed.Verify(signed, bodyHash, &domainKey)
+				return parsed.VerifyResult.Status()
+			}
+			if status := verify(headers); status != dkim.VerifyStatusPass {
+				t.Errorf("expected pass, got %s", status)
+			}
+			// 署名後に From を追加した場合は検証に失敗する
+			appended := append(append([]string{}, headers...), "From: attacker@example.net\r\n")
+			if status := verify(appended); status == dkim.VerifyStatusPass {
+				t.Errorf("expected failure after appending From header")
+			}
+		})
+	}
+}
+
+func Test_setDKIMTimestamp(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	SetClock(func() time.Time { return fixed })
+	defer SetClock(nil)
+
+	disabled := false
+	testCases := []struct {
+		name       string
+		domain     config.Domain
+		timestamp  int64
+		expiration int64
+		value      string
+	}{
+		{
+			name:      "default",
+			domain:    config.Domain{},
+			timestamp: fixed.Unix(),
+			value:     "t=1704164645; v=1;",
+		},
+		{
+			name:       "with TTL",
+			domain:     config.Domain{SignatureTTLDuration: 7 * 24 * time.Hour},
+			timestamp:  fixed.Unix(),
+			expiration: fixed.Unix() + 7*24*60*60,
+			value:      "x=1704769445; s=default; t=1704164645; v=1;",
+		},
+		{
+			name:       "without timestamp",
+			domain:     config.Domain{SignatureTimestamp: &disabled, SignatureTTLDuration: time.Hour},
+			expiration: fixed.Unix() + 60*60,
+			value:      "x=1704168245; s=default; v=1;",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sig := dkim.Signature{
+				Algorithm:        dkim.SignatureAlgorithmRSA_SHA256,
+				Canonicalization: "relaxed/relaxed",
+				Domain:           "example.jp",
+				Selector:         "default",
+				Version:          1,
+			}
+			setDKIMTimestamp(&sig, &tc.domain)
+			if sig.Timestamp != tc.timestamp {
+				t.Errorf("expected t=%d, got %d", tc.timestamp, sig.Timestamp)
+			}
+			if sig.SignatureExpiration != tc.expiration {
+				t.Errorf("expected x=%d, got %d", tc.expiration, sig.SignatureExpiration)
+			}
+			value := strings.Join(strings.Fields(dkimHeaderValue(&sig)), " ")
+			if !strings.Contains(value, tc.value) {
+				t.Errorf("expected %q in %q", tc.value, value)
+			}
+			if tc.timestamp == 0 && strings.Contains(value, "t=") {
+				t.Errorf("unexpected t= in %q", value)
+			}
+		})
+	}
+}
+
+func Test_findResignConflict(t *testing.T) {
+	headers := []string{
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=upstream.example.org; s=app; h=from; bh=dGVzdA==; b=dGVzdA==\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed; d=Example.JP; s=old; h=from; bh=dGVzdA==; b=dGVzdA==\r\n",
+		"From: test@example.jp\r\n",
+	}
+
+	testCases := []struct {
+		name     string
+		headers  []string
+		policy   string
+		d        string
+		selector string
+		expected string
+		found    bool
+	}{
+		{
+			name:     "always",
+			headers:  headers,
+			policy:   "always",
+			d:        "example.jp",
+			selector: "old",
+		},
+		{
+			name:     "any",
+			headers:  headers,
+			policy:   "any",
+			d:        "example.net",
+			selector: "default",
+			expected: "d=upstream.example.org s=app",
+			found:    true,
+		},
+		{
+			name:     "any without signature",
+			headers:  headers[2:],
+			policy:   "any",
+			d:        "example.jp",
+			selector: "default",
+		},
+		{
+			name:     "same-domain",
+			headers:  headers,
+			policy:   "same-domain",
+			d:        "example.jp",
+			selector: "default",
+			expected: "d=Example.JP s=old",
+			found:    true,
+		},
+		{
+			name:     "same-domain other domain",
+			headers:  headers,
+			policy:   "same-domain",
+			d:        "example.net",
+			selector: "default",
+		},
+		{
+			name:     "same-selector",
+			headers:  headers,
+			policy:   "same-selector",
+			d:        "example.jp",
+			selector: "old",
+			expected: "d=Example.JP s=old",
+			found:    true,
+		},
+		{
+			name:     "same-selector other selector",
+			headers:  headers,
+			policy:   "same-selector",
+			d:        "example.jp",
+			selector: "default",
+		},
+		{
+			name:     "any unparsable",
+			headers:  []string{"DKIM-Signature: broken\r\n"},
+			policy:   "any",
+			d:        "example.jp",
+			selector: "default",
+			expected: "unparsable signature",
+			found:    true,
+		},
+		{
+			name:     "same-domain unparsable",
+			headers:  []string{"DKIM-Signature: broken\r\n"},
+			policy:   "same-domain",
+			d:        "example.jp",
+			selector: "default",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actual, found := findResignConflict(tc.headers, tc.policy, tc.d, tc.selector)
+			if found != tc.found {
+				t.Errorf("expected found %v, got %v", tc.found, found)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth"
+	"github.com/masa23/mmauth/arc"
+	"github.com/masa23/mmauth/dkim"
+	"github.com/masa23/mmauth/domainkey"
+)
+
+var debug bool
+
+// SetDebug はデバッグログを出力するかを設定する
+func SetDebug(dbg bool) {
+	debug = dbg
+}
+
+// Envelope は署名を行うかの判定と SPF の検証に使用する SMTP セッションの情報
+type Envelope struct {
+	// 接続元 IP アドレス
+	RemoteAddr net.IP
+	Helo       string
+	MailFrom   string
+	Rcpts      []string
+	// SMTP 認証のユーザー名 (認証していない場合は空)
+	AuthUser string
+	// MTA が確認した接続元のホスト名 (不明な場合は空)
+	Hostname string
+}
+
+// Header は署名で追加するヘッダ
+type Header struct {
+	Name  string
+	Value string
+}
+
+// Message は1通のメッセージの検証と署名を行う
+// AddHeader でヘッダを、EndHeaders でヘッダの終端を、Write で本文を順に渡し、最後に Sign か Verify を呼び出す
+type Message struct {
+	conf         *config.Config
+	listen       *config.MilterListen
+	env          Envelope
+	isARCSign    bool
+	isDKIMSign   bool
+	rcptToDomain string
+	from         string
+	fromDomain   string
+	dkimDomain   string
+	headers      map[string]string
+	mmauth       *mmauth.MMAuth
+	// l= を付与する場合の正規化後の本文の長さ
+	bodyLength *bodyLengthCounter
+	// l= 付きの DKIM 署名を検証するために追加で計算する本文全体の BodyHash
+	fullBodyHashes []mmauth.BodyCanonicalizationAndAlgorithm
+	// DKIM と ARC の公開鍵の参照に使用するリゾルバー、nil の場合は DNS を参照する
+	resolver domainkey.TXTResolver
+	// ヘッダの終端を書き込んだか
+	headersEnded bool
+	// 本文の終端を書き込み検証を行ったか、その際のエラー
+	finished  bool
+	finishErr error
+}
+
+// NewMessage は conf の設定と listen の処理方針で env のメッセージを処理する Message を作成する
+func NewMessage(conf *config.Config, listen *config.MilterListen, env Envelope) *Message {
+	m := &Message{
+		conf:   conf,
+		listen: listen,
+		env:    env,
+		mmauth: mmauth.NewMMAuth(),
+	}
+	for _, rcpt := range env.Rcpts {
+		m.addRcpt(rcpt)
+	}
+	return m
+}
+
+// SetResolver は DKIM と ARC の公開鍵の参照に DNS の代わりに resolver を使用する
+func (m *Message) SetResolver(resolver domainkey.TXTResolver) {
+	m.resolver = resolver
+}
+
+func (m *Message) logError(format string, v ...interface{}) {
+	log.Printf("arcmilter: "+format, v...)
+}
+
+func (m *Message) debugLog(format string, v ...interface{}) {
+	if debug {
+		log.Printf("arcmilter: "+format, v...)
+	}
+}
+
+// addRcpt は宛先が ARC 署名の対象ドメインなら ARC 署名と BodyHash を設定する
+func (m *Message) addRcpt(rcptTo string) {
+	// 検証を行わない待ち受けの場合は ARC 署名を行わない
+	if !m.listen.IsVerify() {
+		return
+	}
+
+	// 送信するメッセージには ARC 署名を行わない
+	if m.isOutbound() {
+		return
+	}
+
+	rcptToDomain, err := mmauth.ParseAddressDomain(rcptTo)
+	if err != nil {
+		m.logError("util.ParseAddressDomain: %v", err)
+		return
+	}
+
+	// 宛先が対象ドメインなら ARC 署名と BodyHash を設定
+	if domain, ok := m.conf.GetMatchingDomain(rcptToDomain); ok && domain.ARC && !m.isARCSign {
+		m.isARCSign = true
+		m.rcptToDomain = rcptToDomain
+		m.mmauth.AddBodyHash(
+			createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0),
+		)
+	}
+}
+
+// isOutbound は SMTP 認証済みか、接続元が MyNetworks、InternalHosts
+// もしくはいずれかのドメインの TrustedNetworks に含まれるかを返す
+func (m *Message) isOutbound() bool {
+	return m.env.AuthUser != "" ||
+		m.conf.IsInternalHost(m.env.RemoteAddr, m.env.Hostname) ||
+		m.conf.IsTrustedNetwork(m.env.RemoteAddr, m.env.Hostname)
+}
+
+// isTrustedSender は接続元に domain の DKIM 署名を許可するかを返す
+// SMTP 認証済みの場合と MyNetworks、InternalHosts に含まれる場合は TrustedNetworks によらず許可する
+func (m *Message) isTrustedSender(domain *config.Domain) bool {
+	return m.env.AuthUser != "" ||
+		m.conf.IsInternalHost(m.env.RemoteAddr, m.env.Hostname) ||
+		domain.IsTrustedSender(m.env.RemoteAddr, m.env.Hostname)
+}
+
+// AddHeader はヘッダを追加する
+// value は ':' の後の空白を1つ取り除いた値で、折り返しの CRLF はそのまま含める
+func (m *Message) AddHeader(name, value string) {
+	if _, err := m.mmauth.Write([]byte(name + ": " + value + "\r\n")); err != nil {
+		m.logError("mmauth.Write: %v", err)
+	}
+
+	// 署名ドメインの決定に使うためヘッダの値を保持する
+	key := strings.ToLower(name)
+	if m.headers == nil {
+		m.headers = make(map[string]string)
+	}
+	m.headers[key] = value
+
+	// l= が本文の一部しか含まないか判定するため本文全体の BodyHash も計算する
+	if key == "dkim-signature" && m.conf.PartialBodyPolicy != config.PartialBodyPolicyAccept {
+		if bca, ok := fullBodyHashConfig(name + ": " + value + "\r\n"); ok {
+			m.fullBodyHashes = append(m.fullBodyHashes, bca)
+		}
+	}
+
+	if key != "from" {
+		return
+	}
+
+	m.from = value
+	fromDomain, err := mmauth.ParseAddressDomain(value)
+	if err != nil {
+		m.logError("util.ParseAddressDomain: %v", err)
+		m.fromDomain = ""
+		return
+	}
+	m.fromDomain = fromDomain
+}
+
+// identityDomain は署名ドメインの決定方法に対応するドメインを返す
+func (m *Message) identityDomain(identity string) string {
+	var address string
+	switch {
+	case identity == config.SigningIdentityFrom:
+		return m.fromDomain
+	case identity == config.SigningIdentityMailFrom:
+		address = m.env.MailFrom
+	case identity == config.SigningIdentityAuth:
+		if m.env.AuthUser == "" {
+			return ""
+		}
+		return m.conf.AuthDomains[m.env.AuthUser]
+	case strings.HasPrefix(identity, config.SigningIdentityHeaderPrefix):
+		name := strings.TrimSpace(identity[len(config.SigningIdentityHeaderPrefix):])
+		address = m.headers[strings.ToLower(name)]
+	}
+	if address == "" {
+		return ""
+	}
+	domain, err := mmauth.ParseAddressDomain(address)
+	if err != nil {
+		m.debugLog("identity %s: util.ParseAddressDomain: %v", identity, err)
+		return ""
+	}
+	return domain
+}
+
+// resolveDKIMDomain は SigningIdentities の順に DKIM 署名を行うドメインを決定する
+func (m *Message) resolveDKIMDomain() (string, *config.Domain, bool) {
+	// DKIM 署名を行わない待ち受けの場合は署名しない
+	if !m.listen.IsSign() {
+		return "", nil, false
+	}
+	for _, identity := range m.listen.SigningIdentities {
+		d := m.identityDomain(identity)
+		if d == "" {
+			continue
+		}
+		if domain, ok := m.conf.GetMatchingDomain(d); ok && domain.DKIM {
+			if !m.isTrustedSender(domain) {
+				m.debugLog("DKIM signing identity %s: %s is not allowed from %s", identity, d, m.env.RemoteAddr)
+				continue
+			}
+			m.debugLog("DKIM signing identity %s: %s", identity, d)
+			return d, domain, true
+		}
+	}
+	return "", nil, false
+}
+
+// EndHeaders はヘッダの終端を書き込む
+// 本文を渡す前に呼び出す必要がある
+func (m *Message) EndHeaders() {
+	if m.headersEnded {
+		return
+	}
+	m.headersEnded = true
+
+	// 署名ドメインが対象ドメインなら DKIM 署名設定
+	// ヘッダ終端を書き込む前に BodyHash を追加する
+	if d, domain, ok := m.resolveDKIMDomain(); ok {
+		m.mmauth.AddBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0))
+		m.dkimDomain = d
+		m.isDKIMSign = true
+		if domain.BodyLengthLimit {
+			m.bodyLength = newBodyLengthCounter(domain.BodyCanonicalization)
+		}
+	} else {
+		m.dkimDomain = ""
+		m.isDKIMSign = false
+	}
+	for _, bca := range m.fullBodyHashes {
+		m.mmauth.AddBodyHash(bca)
+	}
+
+	if _, err := m.mmauth.Write([]byte("\r\n")); err != nil {
+		m.logError("mmauth.Write: %v", err)
+	}
+}
+
+// Write は本文を書き込む
+func (m *Message) Write(p []byte) (int, error) {
+	m.EndHeaders()
+	if _, err := m.mmauth.Write(p); err != nil {
+		m.logError("mmauth.Write: %v", err)
+	}
+	if m.bodyLength != nil {
+		m.bodyLength.Write(p)
+	}
+	return len(p), nil
+}
+
+// finish は本文の終端を書き込み、受信したメッセージの署名を検証する
+func (m *Message) finish() error {
+	if m.finished {
+		return m.finishErr
+	}
+	m.EndHeaders()
+	m.finished = true
+	if err := m.mmauth.Close(); err != nil {
+		m.finishErr = fmt.Errorf("mmauth.Close: %v", err)
+		return m.finishErr
+	}
+	m.verify()
+	return nil
+}
+
+// Close は Sign と Verify を呼び出さずに処理を終える
+func (m *Message) Close() {
+	if m.finished {
+		return
+	}
+	m.finished = true
+	m.finishErr = errors.New("message is closed")
+	if err := m.mmauth.Close(); err != nil {
+		m.logError("mmauth.Close: %v", err)
+	}
+}
+
+// Sign はメッセージの署名を検証し、設定に従って DKIM と ARC の署名を行う
+// 追加するヘッダをメッセージの先頭に並べる順で返す
+// 署名を行わない場合や署名に失敗した場合はそのヘッダを含めない
+func (m *Message) Sign() ([]Header, error) {
+	if err := m.finish(); err != nil {
+		return nil, err
+	}
+
+	var headers []Header
+	// DKIM 署名
+	if h, ok := m.dkimSign(); ok {
+		headers = append(headers, h)
+	}
+	// ARC 署名
+	return append(m.arcSign(), headers...), nil
+}
+
+// getKeyTypeAlgo は公開鍵のタイプから DKIM 署名アルゴリズムを判定する
+func getKeyTypeAlgo(pub interface{}) (dkim.SignatureAlgorithm, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return dkim.SignatureAlgorithmRSA_SHA256, nil
+	case ed25519.PublicKey:
+		return dkim.SignatureAlgorithmED25519_SHA256, nil
+	default:
+		return "", fmt.Errorf("unknown key type: %T", pub)
+	}
+}
+
+// createBodyHashConfig は BodyHash の設定用構造体を生成する
+func createBodyHashConfig(canonicalization string, hashAlgo crypto.Hash, limit int64) mmauth.BodyCanonicalizationAndAlgorithm {
+	return mmauth.BodyCanonicalizationAndAlgorithm{
+		Body:      mmauth.Canonicalization(canonicalization),
+		Algorithm: hashAlgo,
+		Limit:     limit,
+	}
+}
+
+// dkimSign は DKIM 署名を行い DKIM-Signature ヘッダを返す
+func (m *Message) dkimSign() (Header, bool) {
+	if !m.isDKIMSign {
+		return Header{}, false
+	}
+
+	// 対応するドメインのキーがある場合は DKIM 署名を行う
+	domain, ok := m.conf.GetMatchingDomain(m.dkimDomain)
+	if !ok || !domain.DKIM {
+		return Header{}, false
+	}
+
+	// 既に DKIM 署名がある場合は ResignPolicy に従って署名しない
+	if found, ok := findResignConflict(m.mmauth.Headers, domain.ResignPolicy, domain.Domain, domain.Selector); ok {
+		m.logError("DKIM-Signature found (%s) Skip by ResignPolicy %s", found, domain.ResignPolicy)
+		return Header{}, false
+	}
+
+	bodyHash := m.mmauth.GetBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0))
+	if bodyHash == "" {
+		m.logError("DKIM body hash is empty")
+		return Header{}, false
+	}
+
+	algo, err := getKeyTypeAlgo(domain.PrivateKeySigner.Public())
+	if err != nil {
+		m.logError("%v", err)
+		return Header{}, false
+	}
+
+	// DKIM 署名
+	sig := dkim.Signature{
+		Algorithm:        algo,
+		Signature:        "",
+		BodyHash:         bodyHash,
+		Canonicalization: domain.HeaderCanonicalization + "/" + domain.BodyCanonicalization,
+		Domain:           domain.Domain,
+		Selector:         domain.Selector,
+		Version:          1,
+	}
+
+	setDKIMTimestamp(&sig, domain)
+
+	if domain.AUID != "" {
+		auid, err := buildAUID(domain.AUID, domain.Domain, mmauth.ParseAddress(m.from), m.env.AuthUser)
+		if err != nil {
+			m.logError("DKIM i= is not added: %v", err)
+		}
+		sig.Identity = auid
+	}
+
+	// 本文全体の BodyHash に署名し、その長さを l= として記録する
+	// 署名後に本文末尾へ追記されても検証に成功する
+	if domain.BodyLengthLimit && m.bodyLength != nil {
+		sig.Limit = m.bodyLength.Length()
+	}
+
+	names := dkimHeaderNames(m.mmauth.Headers, domain.DKIMSignHeaders, domain.OversignHeaders)
+	if err := signDKIM(&sig, m.mmauth.Headers, names, domain.PrivateKeySigner); err != nil {
+		m.logError("dkim.Sign: %v", err)
+		return Header{}, false
+	}
+
+	// ARC 署名の対象に含めるため追加した DKIM-Signature をヘッダに加える
+	value := dkimHeaderValue(&sig)
+	m.mmauth.Headers = append(m.mmauth.Headers, "DKIM-Signature: "+value)
+	return Header{Name: "DKIM-Signature", Value: value}, true
+}
+
+// arcSign は ARC 署名を行い ARC-Seal、ARC-Message-Signature、ARC-Authentication-Results の順にヘッダを返す
+func (m *Message) arcSign() []Header {
+	if !m.isARCSign {
+		return nil
+	}
+
+	domain, ok := m.conf.GetMatchingDomain(m.rcptToDomain)
+	if !ok || !domain.ARC {
+		return nil
+	}
+	if m.mmauth.AuthenticationHeaders == nil {
+		m.logError("AuthenticationHeaders is nil")
+		return nil
+	}
+	ah := m.mmauth.AuthenticationHeaders.ARCSignatures
+
+	// ARC-Chain-Validation-Result が fail の場合は ARC 署名を行わない
+	if ah.GetARCChainValidation() == arc.ChainValidationResultFail {
+		m.logError("ARC-Chain-Validation-Result is fail skip ARC signing")
+		return nil
+	}
+
+	// 署名アルゴリズムの判定
+	var arcAlgo arc.SignatureAlgorithm
+	switch domain.PrivateKeySigner.Public().(type) {
+	case *rsa.PublicKey:
+		arcAlgo = arc.SignatureAlgorithmRSA_SHA256
+	case ed25519.PublicKey:
+		arcAlgo = arc.SignatureAlgorithmED25519_SHA256
+	default:
+		m.logError("unknown key type: %T", domain.PrivateKeySigner)
+		return nil
+	}
+
+	instanceNumber := ah.GetMaxInstance() + 1
+	signature := arc.ARCMessageSignature{
+		InstanceNumber:   instanceNumber,
+		Algorithm:        arcAlgo,
+		Domain:           m.rcptToDomain,
+		Selector:         domain.ARCSelector,
+		Canonicalization: domain.HeaderCanonicalization + "/" + domain.BodyCanonicalization,
+		BodyHash:         m.mmauth.GetBodyHash(createBodyHashConfig(domain.BodyCanonicalization, domain.HashAlgo, 0)),
+	}
+	if signature.BodyHash == "" {
+		m.logError("ARC body hash is empty")
+		return nil
+	}
+
+	if err := signature.Sign(mmauth.ExtractHeadersDKIM(m.mmauth.Headers, domain.ARCSignHeaders),
+		domain.PrivateKeySigner); err != nil {
+		m.logError("signature.Sign: %v", err)
+		return nil
+	}
+
+	result := arc.ARCAuthenticationResults{
+		InstanceNumber: instanceNumber,
+		AuthServId:     m.rcptToDomain,
+		Results:        m.authenticationResults(),
+	}
+
+	// ARC-Seal 署名
+	seal := arc.ARCSeal{
+		InstanceNumber: instanceNumber,
+		Algorithm:      arcAlgo,
+		Domain:         m.rcptToDomain,
+		Selector:       domain.ARCSelector,
+		ChainValidation: arc.ChainValidationResult(
+			m.mmauth.AuthenticationHeaders.ARCSignatures.GetVerifyResult(),
+		),
+	}
+	headers := m.mmauth.AuthenticationHeaders.ARCSignatures.GetARCHeaders()
+	headers = append(headers, "ARC-Authentication-Results: "+result.String())
+	headers = append(headers, "ARC-Message-Signature: "+signature.String())
+
+	if err := seal.Sign(headers, domain.PrivateKeySigner); err != nil {
+		m.logError("seal.Sign: %v", err)
+		return nil
+	}
+
+	return []Header{
+		{Name: "ARC-Seal", Value: seal.String()},
+		{Name: "ARC-Message-Signature", Value: signature.String()},
+		{Name: "ARC-Authentication-Results", Value: result.String()},
+	}
+}
@@ -0,0 +1,150 @@
+package signer
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"testing"
+
+	"github.com/masa23/arcmilter/config"
+)
+
+func Test_Message_TrustedNetworks(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	parse := func(entries ...string) config.Networks {
+		n, err := config.ParseNetworks("TrustedNetworks", entries)
+		if err != nil {
+			t.Fatalf("failed to parse networks: %v", err)
+		}
+		return n
+	}
+	domain := config.Domain{
+		HeaderCanonicalization: "relaxed",
+		BodyCanonicalization:   "relaxed",
+		HashAlgo:               crypto.SHA256,
+		Selector:               "default",
+		ARCSelector:            "default",
+		PrivateKeySigner:       key,
+		DKIM:                   true,
+		ARC:                    true,
+		DKIMSignHeaders:        []string{"From"},
+		ARCSignHeaders:         []string{"From"},
+		ResignPolicy:           config.ResignPolicyAlways,
+	}
+	customerA := domain
+	customerA.Domain = "a.example.jp"
+	customerA.ParsedTrustedNetworks = parse("192.0.2.0/24", "*.relay.a.example.jp")
+	customerB := domain
+	customerB.Domain = "b.example.jp"
+	customerB.ParsedTrustedNetworks = parse("198.51.100.0/24")
+	open := domain
+	open.Domain = "example.com"
+	conf := &config.Config{
+		PartialBodyPolicy:   config.PartialBodyPolicyAccept,
+		ParsedMyNetworks:    parse("10.0.0.0/8"),
+		ParsedInternalHosts: parse("203.0.113.1", "smtp.example.net"),
+		Domains: map[string]config.Domain{
+			"a.example.jp": customerA,
+			"b.example.jp": customerB,
+			"example.com":  open,
+		},
+	}
+	listen := &config.MilterListen{SigningIdentities: []string{config.SigningIdentityFrom}, Policy: config.ListenPolicyBoth}
+
+	testCases := []struct {
+		name         string
+		env          Envelope
+		from         string
+		expectedDKIM bool
+		expectedARC  bool
+	}{
+		{
+			name:         "customer relay signs own domain",
+			env:          Envelope{RemoteAddr: net.ParseIP("192.0.2.1")},
+			from:         "user@a.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name:         "customer relay by hostname",
+			env:          Envelope{RemoteAddr: net.ParseIP("192.0.2.200"), Hostname: "mx1.relay.a.example.jp"},
+			from:         "user@a.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name: "customer relay cannot sign other customer domain",
+			env:  Envelope{RemoteAddr: net.ParseIP("198.51.100.1")},
+			from: "user@a.example.jp",
+		},
+		{
+			name:         "internal host signs any domain",
+			env:          Envelope{RemoteAddr: net.ParseIP("203.0.113.1")},
+			from:         "user@b.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name:         "internal host by hostname",
+			env:          Envelope{RemoteAddr: net.ParseIP("203.0.113.2"), Hostname: "smtp.example.net"},
+			from:         "user@a.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name:         "MyNetworks signs any domain",
+			env:          Envelope{RemoteAddr: net.ParseIP("10.0.0.1")},
+			from:         "user@b.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name:         "authenticated user signs any domain",
+			env:          Envelope{RemoteAddr: net.ParseIP("203.0.113.200"), AuthUser: "user"},
+			from:         "user@a.example.jp",
+			expectedDKIM: true,
+		},
+		{
+			name:         "domain without TrustedNetworks is signed from anywhere",
+			env:          Envelope{RemoteAddr: net.ParseIP("203.0.113.200")},
+			from:         "user@example.com",
+			expectedDKIM: true,
+			expectedARC:  true,
+		},
+		{
+			name:        "inbound message is ARC signed",
+			env:         Envelope{RemoteAddr: net.ParseIP("203.0.113.200")},
+			from:        "user@a.example.jp",
+			expectedARC: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.env.Rcpts = []string{"user@example.com"}
+			m := NewMessage(conf, listen, tc.env)
+			m.SetResolver(mapResolver{})
+			m.AddHeader("From", tc.from)
+			m.EndHeaders()
+			m.Write([]byte("test message\r\n"))
+			headers, err := m.Sign()
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			var dkim, arc bool
+			for _, h := range headers {
+				switch h.Name {
+				case "DKIM-Signature":
+					dkim = true
+				case "ARC-Seal":
+					arc = true
+				}
+			}
+			if dkim != tc.expectedDKIM {
+				t.Errorf("expected DKIM signature %t, got %t", tc.expectedDKIM, dkim)
+			}
+			if arc != tc.expectedARC {
+				t.Errorf("expected ARC signature %t, got %t", tc.expectedARC, arc)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package signer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/mmauth/arc"
+	"github.com/masa23/mmauth/dkim"
+	"github.com/masa23/mmauth/domainkey"
+)
+
+// VerifyOptions は VerifyMessage で検証する際の SMTP セッションの情報と検証方法
+type VerifyOptions struct {
+	// SPF の検証に使用する接続元 IP アドレス、HELO と MAIL FROM
+	Envelope Envelope
+	// l= が本文の一部しか含まない DKIM 署名の扱い、空の場合は accept
+	PartialBodyPolicy string
+	// DKIM と ARC の公開鍵の参照に使用するリゾルバー、nil の場合は DNS を参照する
+	Resolver domainkey.TXTResolver
+}
+
+// VerifyReport は受信したメッセージの署名の検証結果
+type VerifyReport struct {
+	// DKIM 署名ごとの検証結果
+	DKIM []*dkim.Signature
+	// ARC のインスタンスごとの検証結果 (i=1 から順に並ぶ)
+	ARC []*arc.Signature
+	// ARC チェーンの検証結果
+	ARCChain arc.ChainValidationResult
+	// Authentication-Results に記録する認証結果
+	Results []string
+}
+
+// VerifyMessage は r から読み込んだメッセージを milter のセッションと同じ処理で検証する
+// 改行が LF のみの場合は CRLF に変換する
+func VerifyMessage(r io.Reader, opts VerifyOptions) (*VerifyReport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	fields, body := splitMessage(normalizeCRLF(data))
+
+	policy := opts.PartialBodyPolicy
+	if policy == "" {
+		policy = config.PartialBodyPolicyAccept
+	}
+	m := NewMessage(
+		&config.Config{PartialBodyPolicy: policy},
+		&config.MilterListen{Policy: config.ListenPolicyVerify},
+		opts.Envelope,
+	)
+	m.SetResolver(opts.Resolver)
+	m.writeMessage(fields, body)
+	return m.Verify()
+}
+
+// Verify はメッセージの署名を検証し、署名を行わずに検証結果を返す
+func (m *Message) Verify() (*VerifyReport, error) {
+	if err := m.finish(); err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Results: m.authenticationResults()}
+	if ah := m.mmauth.AuthenticationHeaders; ah != nil {
+		if ah.DKIMSignatures != nil {
+			for _, sig := range *ah.DKIMSignatures {
+				if sig != nil {
+					report.DKIM = append(report.DKIM, sig)
+				}
+			}
+		}
+		for i := 1; i <= ah.ARCSignatures.GetMaxInstance(); i++ {
+			report.ARC = append(report.ARC, ah.ARCSignatures.GetInstance(i))
+		}
+		report.ARCChain = ah.ARCSignatures.GetARCChainValidation()
+	}
+	return report, nil
+}
+
+// verify は受信したメッセージの DKIM と ARC の署名を検証する
+// resolver が設定されている場合は DNS の代わりに resolver で公開鍵を参照する
+func (m *Message) verify() {
+	if m.resolver == nil {
+		m.mmauth.Verify()
+		return
+	}
+	ah := m.mmauth.AuthenticationHeaders
+	if ah == nil {
+		return
+	}
+	if ah.DKIMSignatures != nil {
+		for _, sig := range *ah.DKIMSignatures {
+			can := sig.GetCanonicalizationAndAlgorithm()
+			if can == nil {
+				continue
+			}
+			bodyHash := m.mmauth.GetBodyHash(createBodyHashConfig(string(can.Body), can.HashAlgo, sig.Limit))
+			sig.VerifyWithResolver(m.mmauth.Headers, bodyHash, nil, m.resolver)
+		}
+	}
+	if ah.ARCSignatures != nil {
+		for i := ah.ARCSignatures.GetMaxInstance(); i >= 1; i-- {
+			sig := ah.ARCSignatures.GetInstance(i)
+			ams := sig.GetARCMessageSignature()
+			if ams == nil {
+				continue
+			}
+			can := ams.GetCanonicalizationAndAlgorithm()
+			if can == nil {
+				continue
+			}
+			bodyHash := m.mmauth.GetBodyHash(createBodyHashConfig(string(can.Body), can.HashAlgo, 0))
+			sig.Verify(m.mmauth.Headers, bodyHash, m.arcDomainKey(sig.GetARCSeal()))
+		}
+	}
+}
+
+// arcDomainKey は ARC-Seal の d= と s= の公開鍵を resolver で参照する
+// 公開鍵が見つからない場合は空の公開鍵を返し、検証結果を permerror にする
+func (m *Message) arcDomainKey(seal *arc.ARCSeal) *domainkey.DomainKey {
+	if seal == nil {
+		// ARC-Seal がない場合は公開鍵を参照せずに neutral になる
+		return nil
+	}
+	key, err := domainkey.LookupDKIMDomainKeyWithResolver(seal.Selector, seal.Domain, m.resolver)
+	if err != nil {
+		m.debugLog("ARC domain key %s._domainkey.%s: %v", seal.Selector, seal.Domain, err)
+		return &domainkey.DomainKey{}
+	}
+	return &key
+}
+
+// authenticationResults は Authentication-Results に記録する認証結果を返す
+func (m *Message) authenticationResults() []string {
+	results := m.mmauth.GetAuthenticationHeader(m.env.RemoteAddr, m.env.Helo, m.env.MailFrom)
+	return applyPartialBodyPolicy(results, m.mmauth, m.conf.PartialBodyPolicy)
+}
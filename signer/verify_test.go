@@ -0,0 +1,128 @@
+package signer
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/masa23/mmauth"
+	"github.com/masa23/mmauth/dkim"
+)
+
+// mapResolver は map から TXT レコードを返す
+type mapResolver map[string][]string
+
+func (r mapResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func Test_VerifyMessage(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	resolver := mapResolver{
+		"default._domainkey.example.jp": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+
+	headers := []string{
+		"From: test@example.jp\r\n",
+		"To: outside@example.com\r\n",
+		"Subject: test\r\n",
+	}
+	body := "test message\r\n"
+
+	// 本文の BodyHash を計算して DKIM 署名する
+	m := mmauth.NewMMAuth()
+	m.AddBodyHash(createBodyHashConfig("relaxed", crypto.SHA256, 0))
+	if _, err := m.Write([]byte(strings.Join(headers, "") + "\r\n" + body)); err != nil {
+		t.Fatalf("failed to write message: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	sig := &dkim.Signature{
+		Algorithm:        dkim.SignatureAlgorithmRSA_SHA256,
+		BodyHash:         m.GetBodyHash(createBodyHashConfig("relaxed", crypto.SHA256, 0)),
+		Canonicalization: "relaxed/relaxed",
+		Domain:           "example.jp",
+		Selector:         "default",
+		Version:          1,
+	}
+	if err := signDKIM(sig, headers, []string{"From", "To", "Subject"}, key); err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	message := "DKIM-Signature: " + dkimHeaderValue(sig) + "\r\n" + strings.Join(headers, "") + "\r\n" + body
+
+	testCases := []struct {
+		name     string
+		message  string
+		resolver mapResolver
+		expected dkim.VerifyStatus
+	}{
+		{
+			name:     "pass",
+			message:  message,
+			resolver: resolver,
+			expected: dkim.VerifyStatusPass,
+		},
+		{
+			name:     "LF line endings",
+			message:  strings.ReplaceAll(message, "\r\n", "\n"),
+			resolver: resolver,
+			expected: dkim.VerifyStatusPass,
+		},
+		{
+			name:     "body modified",
+			message:  message + "appended\r\n",
+			resolver: resolver,
+			expected: dkim.VerifyStatusFail,
+		},
+		{
+			name:     "key not found",
+			message:  message,
+			resolver: mapResolver{},
+			expected: dkim.VerifyStatusPermErr,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			report, err := VerifyMessage(strings.NewReader(tc.message), VerifyOptions{Resolver: tc.resolver})
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if len(report.DKIM) != 1 {
+				t.Fatalf("expected 1 DKIM signature, got %d", len(report.DKIM))
+			}
+			if status := report.DKIM[0].VerifyResult.Status(); status != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, status)
+			}
+			if len(report.ARC) != 0 {
+				t.Errorf("expected no ARC instance, got %d", len(report.ARC))
+			}
+			found := false
+			for _, result := range report.Results {
+				if strings.HasPrefix(result, "dkim="+string(tc.expected)) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("dkim=%s not found in %v", tc.expected, report.Results)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+// Package smtpbackend は go-smtp の Backend に DKIM と ARC の署名を追加するミドルウェアを提供する
+package smtpbackend
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/signer"
+)
+
+// AuthUserSession は SMTP 認証のユーザー名を返すセッション
+// 内側の Backend のセッションが実装している場合、その値で SMTP 認証済みか判定する
+type AuthUserSession interface {
+	AuthUser() string
+}
+
+// Resolver は接続元のホスト名の確認に使用するリゾルバー
+// *net.Resolver が実装している
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// lookupTimeout は接続元のホスト名を確認する DNS の問い合わせの時間制限
+const lookupTimeout = 5 * time.Second
+
+// settings はセッション開始時点で使用する設定
+type settings struct {
+	conf   *config.Config
+	listen *config.MilterListen
+	// 設定にホスト名のパターンがあり、接続元のホスト名を確認する必要がある
+	lookupHostname bool
+}
+
+// Backend は受信したメッセージに milter と同じ処理で署名を行い、内側の Backend に渡す
+type Backend struct {
+	backend  smtp.Backend
+	settings atomic.Pointer[settings]
+	// 接続元のホスト名の確認に使用するリゾルバー、nil の場合は net.DefaultResolver を使用する
+	resolver Resolver
+}
+
+// New は conf の設定と listen の処理方針で署名を行い backend に渡す Backend を作成する
+func New(backend smtp.Backend, conf *config.Config, listen *config.MilterListen) *Backend {
+	b := &Backend{backend: backend}
+	b.SetConfig(conf, listen)
+	return b
+}
+
+// SetConfig は新しいセッションで使用する設定を差し替える
+// 処理中のセッションは開始時点の設定で処理を続ける
+func (b *Backend) SetConfig(conf *config.Config, listen *config.MilterListen) {
+	b.settings.Store(&settings{conf: conf, listen: listen, lookupHostname: conf.HasHostPatterns()})
+}
+
+// SetResolver は接続元のホスト名の確認に使用するリゾルバーを設定する
+// セッションを受け付ける前に呼び出す
+func (b *Backend) SetResolver(resolver Resolver) {
+	b.resolver = resolver
+}
+
+// NewSession は内側の Backend のセッションを作成し、署名を行うセッションで包む
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	inner, err := b.backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{
+		Session:  inner,
+		conn:     c,
+		settings: b.settings.Load(),
+		resolver: b.resolver,
+	}
+	if auth, ok := inner.(smtp.AuthSession); ok {
+		return &authSession{session: s, auth: auth}, nil
+	}
+	return s, nil
+}
+
+// session は内側のセッションにエンベロープを渡しつつ記録し、Data で署名したメッセージを渡す
+type session struct {
+	smtp.Session
+	conn     *smtp.Conn
+	settings *settings
+	resolver Resolver
+	mailFrom string
+	rcpts    []string
+}
+
+func (s *session) logError(format string, v ...interface{}) {
+	log.Printf("arcmilter: "+format, v...)
+}
+
+func (s *session) Reset() {
+	s.mailFrom = ""
+	s.rcpts = nil
+	s.Session.Reset()
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if err := s.Session.Mail(from, opts); err != nil {
+		return err
+	}
+	s.mailFrom = from
+	s.rcpts = nil
+	return nil
+}
+
+// Rcpt は内側のセッションが受け付けた宛先のみを署名の判定に使用する
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if err := s.Session.Rcpt(to, opts); err != nil {
+		return err
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+// Data はメッセージに署名して内側のセッションに渡す
+// 署名に失敗した場合は元のメッセージをそのまま渡す
+func (s *session) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if _, err := signer.SignMessage(bytes.NewReader(data), &buf, s.settings.conf, s.settings.listen, s.envelope()); err != nil {
+		s.logError("%v", err)
+		return s.Session.Data(bytes.NewReader(data))
+	}
+	return s.Session.Data(&buf)
+}
+
+// envelope は署名の判定に使用する SMTP セッションの情報を返す
+func (s *session) envelope() signer.Envelope {
+	env := signer.Envelope{
+		RemoteAddr: remoteIP(s.conn.Conn().RemoteAddr()),
+		Helo:       s.conn.Hostname(),
+		MailFrom:   s.mailFrom,
+		Rcpts:      s.rcpts,
+	}
+	if auth, ok := s.Session.(AuthUserSession); ok {
+		env.AuthUser = auth.AuthUser()
+	}
+	// ホスト名のパターンがない場合は判定に使用しないため問い合わせない
+	if s.settings.lookupHostname {
+		env.Hostname = lookupHostname(s.resolver, env.RemoteAddr)
+	}
+	return env
+}
+
+// lookupHostname は ip を逆引きし、正引きで ip に戻るホスト名を返す
+// MTA が milter に渡すホスト名と同じく、確認できなかった場合は空を返す
+func lookupHostname(resolver Resolver, ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	names, err := resolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(ip) {
+				return strings.TrimSuffix(name, ".")
+			}
+		}
+	}
+	return ""
+}
+
+// remoteIP は接続元のアドレスから IP アドレスを取り出す
+// UNIX ドメインソケットなど IP アドレスでない場合は nil を返す
+func remoteIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// authSession は AUTH に対応する内側のセッションを包む
+type authSession struct {
+	*session
+	auth smtp.AuthSession
+}
+
+func (s *authSession) AuthMechanisms() []string {
+	return s.auth.AuthMechanisms()
+}
+
+func (s *authSession) Auth(mech string) (sasl.Server, error) {
+	return s.auth.Auth(mech)
+}
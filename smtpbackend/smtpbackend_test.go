@@ -0,0 +1,277 @@
+package smtpbackend
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/masa23/arcmilter/config"
+	"github.com/masa23/arcmilter/signer"
+	"github.com/masa23/mmauth/arc"
+	"github.com/masa23/mmauth/dkim"
+)
+
+// mapResolver は map から TXT レコードを返す
+type mapResolver map[string][]string
+
+func (r mapResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// hostResolver は map から逆引きと正引きの結果を返し、問い合わせの回数を数える
+type hostResolver struct {
+	ptr     map[string][]string
+	addrs   map[string][]string
+	lookups atomic.Int32
+}
+
+func (r *hostResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.lookups.Add(1)
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func (r *hostResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups.Add(1)
+	var addrs []net.IPAddr
+	for _, addr := range r.addrs[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(addr)})
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// sinkSession は受け取ったメッセージを記録する
+type sinkSession struct {
+	authUser string
+	rcpts    []string
+	data     chan string
+}
+
+func (s *sinkSession) Reset()        {}
+func (s *sinkSession) Logout() error { return nil }
+func (s *sinkSession) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	// 宛先を拒否した場合は署名の判定に使用しない
+	if strings.HasPrefix(to, "reject@") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "rejected"}
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.data <- string(data)
+	return nil
+}
+
+func (s *sinkSession) AuthUser() string {
+	return s.authUser
+}
+
+func Test_Backend(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatalf("failed to marshal public key: %v", err)
+	}
+	resolver := mapResolver{
+		"default._domainkey.example.jp": {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)},
+	}
+	conf := &config.Config{
+		PartialBodyPolicy: config.PartialBodyPolicyAccept,
+		Domains: map[string]config.Domain{
+			"example.jp": {
+				HeaderCanonicalization: "relaxed",
+				BodyCanonicalization:   "relaxed",
+				HashAlgo:               crypto.SHA256,
+				Domain:                 "example.jp",
+				Selector:               "default",
+				ARCSelector:            "default",
+				PrivateKeySigner:       key,
+				DKIM:                   true,
+				ARC:                    true,
+				DKIMSignHeaders:        []string{"From", "To", "Subject"},
+				ARCSignHeaders:         []string{"From", "To", "Subject", "DKIM-Signature"},
+				ResignPolicy:           config.ResignPolicyAlways,
+			},
+		},
+	}
+	listen := &config.MilterListen{SigningIdentities: []string{config.SigningIdentityFrom}, Policy: config.ListenPolicyBoth}
+	message := "From: test@example.jp\r\nTo: user@example.jp\r\nSubject: test\r\n\r\ntest message\r\n"
+
+	testCases := []struct {
+		name            string
+		authUser        string
+		rcpts           []string
+		trustedNetworks []string
+		// 接続元 127.0.0.1 の逆引きと、そのホスト名の正引きの結果
+		ptr          []string
+		addrs        map[string][]string
+		expectedDKIM bool
+		expectedARC  bool
+		// 接続元のホスト名を問い合わせるか
+		expectedLookup bool
+	}{
+		{
+			name:         "DKIM and ARC",
+			rcpts:        []string{"user@example.jp"},
+			expectedDKIM: true,
+			expectedARC:  true,
+		},
+		{
+			name:         "authenticated",
+			authUser:     "test",
+			rcpts:        []string{"user@example.jp"},
+			expectedDKIM: true,
+		},
+		{
+			name:         "rejected recipient",
+			rcpts:        []string{"user@example.com", "reject@example.jp"},
+			expectedDKIM: true,
+		},
+		{
+			name:            "trusted hostname",
+			rcpts:           []string{"user@example.com"},
+			trustedNetworks: []string{"mail.example.jp"},
+			ptr:             []string{"mail.example.jp."},
+			addrs:           map[string][]string{"mail.example.jp.": {"127.0.0.1"}},
+			expectedDKIM:    true,
+			expectedLookup:  true,
+		},
+		{
+			name:            "untrusted hostname",
+			rcpts:           []string{"user@example.com"},
+			trustedNetworks: []string{"mail.example.net"},
+			ptr:             []string{"mail.example.jp."},
+			addrs:           map[string][]string{"mail.example.jp.": {"127.0.0.1"}},
+			expectedDKIM:    false,
+			expectedLookup:  true,
+		},
+		{
+			// 正引きで接続元のアドレスに戻らないホスト名は使用しない
+			name:            "hostname not confirmed",
+			rcpts:           []string{"user@example.com"},
+			trustedNetworks: []string{"mail.example.jp"},
+			ptr:             []string{"mail.example.jp."},
+			addrs:           map[string][]string{"mail.example.jp.": {"192.0.2.1"}},
+			expectedDKIM:    false,
+			expectedLookup:  true,
+		},
+		{
+			// ホスト名のパターンがない場合は問い合わせない
+			name:            "trusted network without hostname",
+			rcpts:           []string{"user@example.com"},
+			trustedNetworks: []string{"127.0.0.0/8"},
+			ptr:             []string{"mail.example.jp."},
+			addrs:           map[string][]string{"mail.example.jp.": {"127.0.0.1"}},
+			expectedDKIM:    true,
+			expectedLookup:  false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := *conf
+			domain := conf.Domains["example.jp"]
+			trusted, err := config.ParseNetworks("TrustedNetworks", tc.trustedNetworks)
+			if err != nil {
+				t.Fatalf("failed to parse networks: %v", err)
+			}
+			domain.ParsedTrustedNetworks = trusted
+			conf.Domains = map[string]config.Domain{"example.jp": domain}
+
+			sink := &sinkSession{authUser: tc.authUser, data: make(chan string, 1)}
+			b := New(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+				return sink, nil
+			}), &conf, listen)
+			hosts := &hostResolver{ptr: map[string][]string{"127.0.0.1": tc.ptr}, addrs: tc.addrs}
+			b.SetResolver(hosts)
+
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			server := smtp.NewServer(b)
+			server.Domain = "localhost"
+			go server.Serve(l)
+			defer server.Close()
+
+			c, err := smtp.Dial(l.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer c.Close()
+			if err := c.Hello("client.example.jp"); err != nil {
+				t.Fatalf("failed to send HELO: %v", err)
+			}
+			if err := c.Mail("test@example.jp", nil); err != nil {
+				t.Fatalf("failed to send MAIL: %v", err)
+			}
+			for _, rcpt := range tc.rcpts {
+				c.Rcpt(rcpt, nil)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatalf("failed to send DATA: %v", err)
+			}
+			io.WriteString(w, message)
+			if err := w.Close(); err != nil {
+				t.Fatalf("failed to send message: %v", err)
+			}
+			received := <-sink.data
+
+			// 元のメッセージは変更せずにヘッダを先頭に追加する
+			if !strings.HasSuffix(received, message) {
+				t.Errorf("original message is modified: %q", received)
+			}
+			report, err := signer.VerifyMessage(strings.NewReader(received), signer.VerifyOptions{Resolver: resolver})
+			if err != nil {
+				t.Fatalf("failed to verify: %v", err)
+			}
+			if tc.expectedDKIM {
+				if len(report.DKIM) != 1 || report.DKIM[0].VerifyResult.Status() != dkim.VerifyStatusPass {
+					t.Errorf("DKIM signature is not verified: %v", report.Results)
+				}
+			} else if len(report.DKIM) != 0 {
+				t.Errorf("unexpected DKIM signature: %v", report.Results)
+			}
+			if tc.expectedARC {
+				if len(report.ARC) != 1 || report.ARCChain != arc.ChainValidationResultPass {
+					t.Errorf("ARC chain is not verified: %v", report.Results)
+				}
+			} else if len(report.ARC) != 0 {
+				t.Errorf("unexpected ARC instance: %v", report.Results)
+			}
+			if lookup := hosts.lookups.Load() > 0; lookup != tc.expectedLookup {
+				t.Errorf("expected lookup %t, got %t", tc.expectedLookup, lookup)
+			}
+		})
+	}
+}